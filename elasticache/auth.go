@@ -0,0 +1,101 @@
+package elasticache
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/coroot/coroot-aws-agent/flags"
+	"github.com/gomodule/redigo/redis"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tagRedisSecret = "coroot-redis-secret"
+	tagRedisUser   = "coroot-redis-user"
+
+	secretCacheTTL = 5 * time.Minute
+)
+
+type redisCredentials struct {
+	user     string
+	password string
+}
+
+// resolveRedisCredentials resolves the credentials of a cluster: the secret referenced by the cluster tags takes precedence
+// over the one from the flags, which takes precedence over the user and password from the flags
+func resolveRedisCredentials(sess *session.Session, tags map[string]string) (redisCredentials, error) {
+	creds := redisCredentials{user: *flags.ElasticacheRedisUser, password: *flags.ElasticacheRedisPassword}
+	secretId := tags[tagRedisSecret]
+	if secretId == "" {
+		secretId = *flags.ElasticacheRedisSecret
+	}
+	if secretId != "" {
+		var err error
+		if creds, err = secrets.get(sess, secretId); err != nil {
+			return creds, err
+		}
+	}
+	if user := tags[tagRedisUser]; user != "" {
+		creds.user = user
+	}
+	return creds, nil
+}
+
+type cachedSecret struct {
+	creds     redisCredentials
+	fetchedAt time.Time
+}
+
+type secretCache struct {
+	secrets map[string]cachedSecret
+	lock    sync.Mutex
+}
+
+var secrets = &secretCache{secrets: map[string]cachedSecret{}}
+
+func (c *secretCache) get(sess *session.Session, secretId string) (redisCredentials, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if s, ok := c.secrets[secretId]; ok && time.Since(s.fetchedAt) < secretCacheTTL {
+		return s.creds, nil
+	}
+	out, err := secretsmanager.New(sess).GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: aws.String(secretId)})
+	if err != nil {
+		return redisCredentials{}, fmt.Errorf("failed to get secret %s: %w", secretId, err)
+	}
+	value := strings.TrimSpace(aws.StringValue(out.SecretString))
+	creds := redisCredentials{password: value}
+	if strings.HasPrefix(value, "{") {
+		var v struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			return redisCredentials{}, fmt.Errorf("failed to parse secret %s: %w", secretId, err)
+		}
+		creds = redisCredentials{user: v.Username, password: v.Password}
+	}
+	c.secrets[secretId] = cachedSecret{creds: creds, fetchedAt: time.Now()}
+	return creds, nil
+}
+
+// redisDialOptions returns the options to connect to a node, the server certificate is verified against the hostname
+func redisDialOptions(useTLS bool, creds redisCredentials) []redis.DialOption {
+	opts := []redis.DialOption{
+		redis.DialConnectTimeout(*flags.ElasticacheConnectTimeout),
+		redis.DialReadTimeout(*flags.ElasticacheConnectTimeout),
+		redis.DialWriteTimeout(*flags.ElasticacheConnectTimeout),
+		redis.DialUseTLS(useTLS),
+	}
+	if creds.user != "" {
+		opts = append(opts, redis.DialUsername(creds.user))
+	}
+	if creds.password != "" {
+		opts = append(opts, redis.DialPassword(creds.password))
+	}
+	return opts
+}
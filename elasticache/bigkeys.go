@@ -0,0 +1,238 @@
+package elasticache
+
+import (
+	"fmt"
+	"github.com/coroot/coroot-aws-agent/flags"
+	"github.com/coroot/coroot-aws-agent/utils"
+	"github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	scanCount         = 100
+	maxPrefixes       = 10000
+	prefixNone        = "<none>"
+	prefixOther       = "<other>"
+	replicationMaster = "master"
+)
+
+var (
+	dBigKeysPrefixMemory = utils.Desc("aws_elasticache_bigkeys_prefix_memory_bytes", "Memory used by the sampled keys with the prefix according to MEMORY USAGE", "prefix")
+	dBigKeysPrefixKeys   = utils.Desc("aws_elasticache_bigkeys_prefix_keys", "Number of the sampled keys with the prefix", "prefix")
+	dBigKeysSampledKeys  = utils.Desc("aws_elasticache_bigkeys_sampled_keys", "Number of keys sampled during the keyspace pass the prefix metrics are based on")
+	dBigKeysPassComplete = utils.Desc("aws_elasticache_bigkeys_pass_complete", "Whether the prefix metrics are based on a complete pass over the keyspace (1) or on the pass in progress (0)")
+)
+
+type prefixStats struct {
+	bytes float64
+	keys  float64
+}
+
+// keySampler walks the keyspace with SCAN and measures the keys with MEMORY USAGE within a per-round budget.
+// A pass over the keyspace usually spans many rounds: the SCAN cursor and the unmeasured keys are kept between them,
+// the stats of the last complete pass are exported.
+// The rounds are run by a single goroutine, the lock guards the stats read by the scrapes.
+type keySampler struct {
+	prefix func(key string) string
+
+	cursor  int64
+	pending []string
+
+	current     map[string]*prefixStats
+	sampled     int
+	last        map[string]*prefixStats
+	lastSampled int
+	lock        sync.Mutex
+}
+
+func newKeySampler() *keySampler {
+	s := &keySampler{current: map[string]*prefixStats{}}
+	if re := *flags.ElasticacheBigKeysRegex; re != nil {
+		s.prefix = func(key string) string {
+			m := re.FindStringSubmatch(key)
+			switch {
+			case m == nil:
+				return prefixNone
+			case len(m) > 1:
+				return m[1]
+			}
+			return m[0]
+		}
+	} else {
+		delimiter := *flags.ElasticacheBigKeysDelim
+		s.prefix = func(key string) string {
+			if prefix, _, ok := strings.Cut(key, delimiter); ok && delimiter != "" {
+				return prefix
+			}
+			return prefixNone
+		}
+	}
+	return s
+}
+
+// reset drops the stats, e.g. after the node has been promoted to primary
+func (s *keySampler) reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cursor, s.pending, s.sampled = 0, nil, 0
+	s.current = map[string]*prefixStats{}
+	s.last, s.lastSampled = nil, 0
+}
+
+// sample continues the pass until the time or command budget is exhausted, every command is given the rest of the time budget.
+// It does nothing on primary nodes unless explicitly allowed as SCAN and MEMORY USAGE compete with the application traffic.
+func (s *keySampler) sample(conn redis.Conn, clusterMode bool) error {
+	deadline := time.Now().Add(*flags.ElasticacheBigKeysTime)
+	budget := *flags.ElasticacheBigKeysCmds
+	do := func(cmd string, args ...interface{}) (interface{}, error) {
+		budget--
+		return redis.DoWithTimeout(conn, time.Until(deadline), cmd, args...)
+	}
+
+	info, err := redis.String(do("INFO", "replication"))
+	if err != nil {
+		return err
+	}
+	if replicationRole(info) == replicationMaster && !*flags.ElasticacheBigKeysPrimary {
+		s.reset()
+		return nil
+	}
+	if clusterMode {
+		// replicas of a cluster redirect keyed commands to the primary unless READONLY is set for the connection
+		if _, err := do("READONLY"); err != nil {
+			return err
+		}
+	}
+
+	for budget > 0 && time.Now().Before(deadline) {
+		if len(s.pending) == 0 {
+			reply, err := redis.Values(do("SCAN", s.cursor, "COUNT", scanCount))
+			if err != nil {
+				return err
+			}
+			if len(reply) != 2 {
+				return fmt.Errorf("unexpected SCAN reply")
+			}
+			cursor, err := redis.Int64(reply[0], nil)
+			if err != nil {
+				return err
+			}
+			keys, err := redis.Strings(reply[1], nil)
+			if err != nil {
+				return err
+			}
+			s.cursor, s.pending = cursor, keys
+			if s.cursor == 0 && len(s.pending) == 0 {
+				s.complete()
+				return nil
+			}
+			continue
+		}
+		key := s.pending[0]
+		s.pending = s.pending[1:]
+		size, err := redis.Int64(do("MEMORY", "USAGE", key))
+		switch {
+		case err == redis.ErrNil: // the key has expired or been deleted since SCAN
+		case err != nil:
+			return err
+		default:
+			s.observe(key, float64(size))
+		}
+		if s.cursor == 0 && len(s.pending) == 0 {
+			s.complete()
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *keySampler) observe(key string, size float64) {
+	prefix := s.prefix(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	st := s.current[prefix]
+	if st == nil {
+		if len(s.current) >= maxPrefixes {
+			prefix = prefixOther
+			st = s.current[prefix]
+		}
+		if st == nil {
+			st = &prefixStats{}
+			s.current[prefix] = st
+		}
+	}
+	st.bytes += size
+	st.keys++
+	s.sampled++
+}
+
+func (s *keySampler) complete() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.last, s.lastSampled = s.current, s.sampled
+	s.current, s.sampled = map[string]*prefixStats{}, 0
+}
+
+func (s *keySampler) collect(ch chan<- prometheus.Metric) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats, sampled, complete := s.last, s.lastSampled, true
+	if stats == nil {
+		stats, sampled, complete = s.current, s.sampled, false
+	}
+	if sampled == 0 {
+		return
+	}
+	ch <- utils.Gauge(dBigKeysSampledKeys, float64(sampled))
+	if complete {
+		ch <- utils.Gauge(dBigKeysPassComplete, 1)
+	} else {
+		ch <- utils.Gauge(dBigKeysPassComplete, 0)
+	}
+	for _, prefix := range topPrefixes(stats, *flags.ElasticacheBigKeysTop) {
+		st := stats[prefix]
+		ch <- utils.Gauge(dBigKeysPrefixMemory, st.bytes, prefix)
+		ch <- utils.Gauge(dBigKeysPrefixKeys, st.keys, prefix)
+	}
+}
+
+// topPrefixes returns the union of the top n prefixes by memory and by number of keys
+func topPrefixes(stats map[string]*prefixStats, n int) []string {
+	prefixes := make([]string, 0, len(stats))
+	for p := range stats {
+		prefixes = append(prefixes, p)
+	}
+	if n <= 0 || len(prefixes) <= n {
+		return prefixes
+	}
+	res := map[string]bool{}
+	for _, less := range []func(a, b *prefixStats) bool{
+		func(a, b *prefixStats) bool { return a.bytes > b.bytes },
+		func(a, b *prefixStats) bool { return a.keys > b.keys },
+	} {
+		sort.Slice(prefixes, func(i, j int) bool {
+			return less(stats[prefixes[i]], stats[prefixes[j]])
+		})
+		for _, p := range prefixes[:n] {
+			res[p] = true
+		}
+	}
+	top := make([]string, 0, len(res))
+	for p := range res {
+		top = append(top, p)
+	}
+	return top
+}
+
+func replicationRole(info string) string {
+	for _, line := range strings.Split(info, "\n") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(line), ":"); ok && k == "role" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,48 @@
+package elasticache
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestTopPrefixes(t *testing.T) {
+	stats := map[string]*prefixStats{
+		"session": {bytes: 1000, keys: 10},
+		"user":    {bytes: 100, keys: 500},
+		"cache":   {bytes: 500, keys: 50},
+		"lock":    {bytes: 1, keys: 1},
+	}
+	tests := []struct {
+		n        int
+		expected []string
+	}{
+		{n: 0, expected: []string{"cache", "lock", "session", "user"}},
+		{n: 10, expected: []string{"cache", "lock", "session", "user"}},
+		{n: 1, expected: []string{"session", "user"}},
+		{n: 2, expected: []string{"cache", "session", "user"}},
+	}
+	for _, tt := range tests {
+		got := topPrefixes(stats, tt.n)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("top %d: expected %v, got %v", tt.n, tt.expected, got)
+		}
+	}
+}
+
+func TestReplicationRole(t *testing.T) {
+	tests := []struct {
+		info     string
+		expected string
+	}{
+		{info: "# Replication\r\nrole:master\r\nconnected_slaves:1\r\n", expected: "master"},
+		{info: "# Replication\r\nrole:slave\r\nmaster_host:10.0.0.1\r\n", expected: "slave"},
+		{info: "", expected: ""},
+	}
+	for _, tt := range tests {
+		if got := replicationRole(tt.info); got != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.info, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package elasticache
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/coroot/coroot-aws-agent/utils"
+	"github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"strings"
+)
+
+var (
+	dClusterUp         = utils.Desc("aws_elasticache_cluster_up", "Whether the cluster state was successfully retrieved via the configuration endpoint")
+	dClusterState      = utils.Desc("aws_elasticache_cluster_state", "State of the Redis cluster according to CLUSTER INFO", "state")
+	dClusterSlots      = utils.Desc("aws_elasticache_cluster_slots", "Number of hash slots by state according to CLUSTER INFO", "state")
+	dClusterKnownNodes = utils.Desc("aws_elasticache_cluster_known_nodes", "Number of nodes known to the cluster")
+	dClusterSize       = utils.Desc("aws_elasticache_cluster_size", "Number of shards serving at least one hash slot")
+	dShardSlots        = utils.Desc("aws_elasticache_shard_slots", "Number of hash slots served by the shard", "shard")
+	dShardNodeHealth   = utils.Desc("aws_elasticache_shard_node_health", "Health of the node according to CLUSTER SHARDS", "shard", "node", "role", "health")
+)
+
+type clusterNode struct {
+	endpoint string
+	role     string
+	health   string
+}
+
+type clusterShard struct {
+	slots [][2]int
+	nodes []clusterNode
+}
+
+// collectCluster collects the state of a cluster-mode-enabled replication group via its configuration endpoint
+func collectCluster(ch chan<- prometheus.Metric, pool *redis.Pool, group *elasticache.ReplicationGroup) error {
+	if pool == nil {
+		return fmt.Errorf("configuration endpoint is not defined")
+	}
+	conn, err := getConn(pool)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	info, err := redis.String(conn.Do("CLUSTER", "INFO"))
+	if err != nil {
+		return fmt.Errorf("CLUSTER INFO failed: %w", err)
+	}
+	shards, err := clusterShards(conn)
+	if err != nil {
+		return err
+	}
+
+	ch <- utils.Gauge(dClusterUp, 1)
+	for _, line := range strings.Split(info, "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "cluster_state":
+			ch <- utils.Gauge(dClusterState, 1, v)
+		case "cluster_slots_assigned", "cluster_slots_ok", "cluster_slots_pfail", "cluster_slots_fail":
+			if n, err := strconv.ParseFloat(v, 64); err == nil {
+				ch <- utils.Gauge(dClusterSlots, n, strings.TrimPrefix(k, "cluster_slots_"))
+			}
+		case "cluster_known_nodes":
+			if n, err := strconv.ParseFloat(v, 64); err == nil {
+				ch <- utils.Gauge(dClusterKnownNodes, n)
+			}
+		case "cluster_size":
+			if n, err := strconv.ParseFloat(v, 64); err == nil {
+				ch <- utils.Gauge(dClusterSize, n)
+			}
+		}
+	}
+	for _, s := range shards {
+		if len(s.slots) == 0 {
+			continue
+		}
+		shard := shardId(group, s.slots[0][0])
+		slots := 0
+		for _, r := range s.slots {
+			slots += r[1] - r[0] + 1
+		}
+		ch <- utils.Gauge(dShardSlots, float64(slots), shard)
+		for _, n := range s.nodes {
+			ch <- utils.Gauge(dShardNodeHealth, 1, shard, n.endpoint, n.role, n.health)
+		}
+	}
+	return nil
+}
+
+// clusterShards uses CLUSTER SHARDS (Redis 7+) and falls back to CLUSTER SLOTS
+func clusterShards(conn redis.Conn) ([]clusterShard, error) {
+	reply, err := redis.Values(conn.Do("CLUSTER", "SHARDS"))
+	if err != nil {
+		if _, ok := err.(redis.Error); !ok {
+			return nil, fmt.Errorf("CLUSTER SHARDS failed: %w", err)
+		}
+		if reply, err = redis.Values(conn.Do("CLUSTER", "SLOTS")); err != nil {
+			return nil, fmt.Errorf("CLUSTER SLOTS failed: %w", err)
+		}
+		return parseClusterSlots(reply), nil
+	}
+	var res []clusterShard
+	for _, item := range reply {
+		fields, _ := redis.Values(item, nil)
+		var s clusterShard
+		for i := 0; i+1 < len(fields); i += 2 {
+			key, _ := redis.String(fields[i], nil)
+			switch key {
+			case "slots":
+				bounds, _ := redis.Ints(fields[i+1], nil)
+				for j := 0; j+1 < len(bounds); j += 2 {
+					s.slots = append(s.slots, [2]int{bounds[j], bounds[j+1]})
+				}
+			case "nodes":
+				nodes, _ := redis.Values(fields[i+1], nil)
+				for _, n := range nodes {
+					attrs, _ := redis.Values(n, nil)
+					node := clusterNode{}
+					var ip, hostname, port string
+					for k := 0; k+1 < len(attrs); k += 2 {
+						name, _ := redis.String(attrs[k], nil)
+						value := replyString(attrs[k+1])
+						switch name {
+						case "ip":
+							ip = value
+						case "endpoint":
+							hostname = value
+						case "port", "tls-port":
+							if value != "" && value != "0" {
+								port = value
+							}
+						case "role":
+							node.role = value
+						case "health":
+							node.health = value
+						}
+					}
+					if hostname == "" || hostname == "?" {
+						hostname = ip
+					}
+					node.endpoint = hostname + ":" + port
+					s.nodes = append(s.nodes, node)
+				}
+			}
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+func parseClusterSlots(reply []interface{}) []clusterShard {
+	shards := map[string]*clusterShard{}
+	var res []clusterShard
+	var order []string
+	for _, item := range reply {
+		fields, _ := redis.Values(item, nil)
+		if len(fields) < 3 {
+			continue
+		}
+		start, _ := redis.Int(fields[0], nil)
+		end, _ := redis.Int(fields[1], nil)
+		var nodes []clusterNode
+		for i, f := range fields[2:] {
+			n, _ := redis.Values(f, nil)
+			if len(n) < 2 {
+				continue
+			}
+			role := "replica"
+			if i == 0 {
+				role = "master"
+			}
+			nodes = append(nodes, clusterNode{endpoint: replyString(n[0]) + ":" + replyString(n[1]), role: role, health: "unknown"})
+		}
+		if len(nodes) == 0 {
+			continue
+		}
+		// a shard may serve several slot ranges, the ranges are grouped by the primary node
+		primary := nodes[0].endpoint
+		s := shards[primary]
+		if s == nil {
+			s = &clusterShard{nodes: nodes}
+			shards[primary] = s
+			order = append(order, primary)
+		}
+		s.slots = append(s.slots, [2]int{start, end})
+	}
+	for _, p := range order {
+		res = append(res, *shards[p])
+	}
+	return res
+}
+
+func replyString(v interface{}) string {
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+	return ""
+}
+
+// shardId returns the ID of the node group serving the given slot according to the replication group description
+func shardId(g *elasticache.ReplicationGroup, slot int) string {
+	for _, ng := range g.NodeGroups {
+		for _, r := range strings.Split(aws.StringValue(ng.Slots), ",") {
+			from, to, ok := strings.Cut(r, "-")
+			if !ok {
+				to = from
+			}
+			f, err1 := strconv.Atoi(strings.TrimSpace(from))
+			t, err2 := strconv.Atoi(strings.TrimSpace(to))
+			if err1 == nil && err2 == nil && slot >= f && slot <= t {
+				return aws.StringValue(ng.NodeGroupId)
+			}
+		}
+	}
+	return strconv.Itoa(slot)
+}
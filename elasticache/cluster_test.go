@@ -0,0 +1,71 @@
+package elasticache
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseClusterSlots(t *testing.T) {
+	node := func(host string, port int64) interface{} {
+		return []interface{}{[]byte(host), port, []byte("id")}
+	}
+	tests := []struct {
+		name     string
+		reply    []interface{}
+		expected []clusterShard
+	}{
+		{
+			name:     "empty",
+			reply:    nil,
+			expected: nil,
+		},
+		{
+			name: "shard with a replica",
+			reply: []interface{}{
+				[]interface{}{int64(0), int64(8191), node("10.0.0.1", 6379), node("10.0.0.2", 6379)},
+			},
+			expected: []clusterShard{
+				{
+					slots: [][2]int{{0, 8191}},
+					nodes: []clusterNode{
+						{endpoint: "10.0.0.1:6379", role: "master", health: "unknown"},
+						{endpoint: "10.0.0.2:6379", role: "replica", health: "unknown"},
+					},
+				},
+			},
+		},
+		{
+			name: "ranges grouped by primary",
+			reply: []interface{}{
+				[]interface{}{int64(0), int64(100), node("10.0.0.1", 6379)},
+				[]interface{}{int64(101), int64(16383), node("10.0.0.3", 6379)},
+				[]interface{}{int64(200), int64(300), node("10.0.0.1", 6379)},
+			},
+			expected: []clusterShard{
+				{
+					slots: [][2]int{{0, 100}, {200, 300}},
+					nodes: []clusterNode{{endpoint: "10.0.0.1:6379", role: "master", health: "unknown"}},
+				},
+				{
+					slots: [][2]int{{101, 16383}},
+					nodes: []clusterNode{{endpoint: "10.0.0.3:6379", role: "master", health: "unknown"}},
+				},
+			},
+		},
+		{
+			name: "malformed entries skipped",
+			reply: []interface{}{
+				[]interface{}{int64(0), int64(100)},
+				[]interface{}{int64(0), int64(100), []interface{}{[]byte("10.0.0.1")}},
+			},
+			expected: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseClusterSlots(tt.reply); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+}
@@ -8,11 +8,13 @@ import (
 	"github.com/coroot/coroot-aws-agent/flags"
 	"github.com/coroot/coroot-aws-agent/utils"
 	"github.com/coroot/logger"
+	"github.com/gomodule/redigo/redis"
 	"github.com/oliver006/redis_exporter/exporter"
 	"github.com/prometheus/client_golang/prometheus"
 	mcExporter "github.com/prometheus/memcached_exporter/pkg/exporter"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -21,7 +23,9 @@ var (
 		"region", "availability_zone", "endpoint", "ipv4", "port",
 		"engine", "engine_version", "instance_type", "cluster_id",
 	)
-	dStatus = utils.Desc("aws_elasticache_status", "Status of the Elasticache instance", "status")
+	dStatus    = utils.Desc("aws_elasticache_status", "Status of the Elasticache instance", "status")
+	dFailovers = utils.Desc("aws_elasticache_failovers_total",
+		"Number of detected failovers of the node: its endpoint started resolving to another IP or its role in the replication group changed")
 )
 
 type Collector struct {
@@ -30,12 +34,28 @@ type Collector struct {
 	metricCollector prometheus.Collector
 	cluster         elasticache.CacheCluster
 	node            elasticache.CacheNode
+	group           *elasticache.ReplicationGroup
 	ip              *net.IPAddr
+	failovers       int
+	tags            map[string]string
+	creds           redisCredentials
+	redisPool       *redis.Pool
+	serverEngine    string
+	serverVersion   string
+	slowlog         *slowlogCollector
+	sampler         *keySampler
+	health          *utils.Health
 
-	logger logger.Logger
+	events        map[eventKey]*eventStats
+	updateActions []updateAction
+
+	lock      sync.Mutex
+	stop      chan bool
+	closeOnce sync.Once
+	logger    logger.Logger
 }
 
-func NewCollector(sess *session.Session, cluster *elasticache.CacheCluster, node *elasticache.CacheNode) (*Collector, error) {
+func NewCollector(sess *session.Session, cluster *elasticache.CacheCluster, node *elasticache.CacheNode, tags map[string]string) (*Collector, error) {
 	if node.Endpoint == nil || node.Endpoint.Address == nil {
 		return nil, fmt.Errorf("endpoint is not defined")
 	}
@@ -43,37 +63,112 @@ func NewCollector(sess *session.Session, cluster *elasticache.CacheCluster, node
 		sess:    sess,
 		cluster: *cluster,
 		node:    *node,
+		tags:    tags,
+		health:  utils.NewHealth("cache"),
+		events:  map[eventKey]*eventStats{},
+		stop:    make(chan bool),
 		logger:  logger.NewKlog(aws.StringValue(cluster.CacheClusterId)),
 	}
 	var err error
 	if c.ip, err = net.ResolveIPAddr("", aws.StringValue(c.node.Endpoint.Address)); err != nil {
 		return nil, err
 	}
-	c.startMetricCollector()
+	var creds redisCredentials
+	var credsErr error
+	if isRedisProtocol(aws.StringValue(cluster.Engine)) {
+		creds, credsErr = resolveRedisCredentials(sess, tags)
+		c.slowlog = newSlowlogCollector()
+		if *flags.ElasticacheBigKeys {
+			c.sampler = newKeySampler()
+			go c.runSampler()
+		}
+	}
+	c.startMetricCollector(creds, credsErr)
 	return c, nil
 }
 
-func (c *Collector) update(cluster *elasticache.CacheCluster, n *elasticache.CacheNode) {
-	if aws.Int64Value(c.node.Endpoint.Port) != aws.Int64Value(n.Endpoint.Port) || aws.StringValue(c.node.Endpoint.Address) != aws.StringValue(n.Endpoint.Address) {
-		c.cluster = *cluster
-		c.node = *n
-		c.startMetricCollector()
+func (c *Collector) update(cluster *elasticache.CacheCluster, n *elasticache.CacheNode, group *elasticache.ReplicationGroup, tags map[string]string) {
+	// the DNS and Secrets Manager requests are made before locking, so they don't delay the scrapes
+	ip, err := net.ResolveIPAddr("", aws.StringValue(n.Endpoint.Address))
+	var creds redisCredentials
+	var credsErr error
+	if isRedisProtocol(aws.StringValue(cluster.Engine)) {
+		creds, credsErr = resolveRedisCredentials(c.sess, tags)
 	}
-	ip, err := net.ResolveIPAddr("", aws.StringValue(c.node.Endpoint.Address))
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	endpointChanged := aws.Int64Value(c.node.Endpoint.Port) != aws.Int64Value(n.Endpoint.Port) || aws.StringValue(c.node.Endpoint.Address) != aws.StringValue(n.Endpoint.Address)
+	ipChanged := false
+	prevIp := c.ip
 	if err != nil {
 		c.logger.Error(err)
 	} else {
+		ipChanged = !ip.IP.Equal(c.ip.IP)
 		c.ip = ip
 	}
+	prevRole := c.role()
+	if aws.StringValue(cluster.EngineVersion) != aws.StringValue(c.cluster.EngineVersion) {
+		c.serverEngine, c.serverVersion = "", ""
+	}
 	c.cluster = *cluster
 	c.node = *n
+	c.group = group
+	c.tags = tags
+	role := c.role()
+	roleChanged := prevRole != "" && role != "" && role != prevRole
+	if !endpointChanged && (ipChanged || roleChanged) {
+		c.logger.Infof("failover detected: ip %s -> %s, role %s -> %s", prevIp, c.ip, prevRole, role)
+		c.failovers++
+	}
+	credsChanged := false
+	if credsErr != nil {
+		c.logger.Warning(credsErr)
+	} else {
+		credsChanged = creds != c.creds
+	}
+	if endpointChanged || ipChanged {
+		// the node endpoint may resolve to another IP after a failover or a node replacement,
+		// the connections to the previous address are closed before connecting to the new one
+		c.logger.Info("the endpoint has changed, restarting the collector:", aws.StringValue(n.Endpoint.Address), c.ip)
+		c.stopMetricCollector()
+		c.startMetricCollector(creds, credsErr)
+	} else if credsChanged {
+		c.logger.Info("the credentials have changed, restarting the collector")
+		c.startMetricCollector(creds, credsErr)
+	} else if !c.health.Up() && c.health.RetryDue() {
+		c.logger.Info("retrying to init the collector")
+		c.startMetricCollector(creds, credsErr)
+	}
 }
 
-func (c *Collector) startMetricCollector() {
+// startMetricCollector (re)starts the exporter, the credentials are resolved by the caller and used only for Redis and Valkey.
+// redis_exporter and memcached_exporter open a new connection on every scrape and don't accept a connection or a pool,
+// so only the agent's own connections (engine info, slowlog, key sampling) are pooled and reused across scrapes.
+func (c *Collector) startMetricCollector(creds redisCredentials, credsErr error) {
+	c.stopMetricCollector()
 	switch aws.StringValue(c.cluster.Engine) {
-	case "redis":
-		url := fmt.Sprintf("redis://%s:%d", c.ip.String(), aws.Int64Value(c.node.Endpoint.Port))
+	case "redis", "valkey":
+		if credsErr != nil {
+			c.logger.Warning("failed to get redis credentials:", credsErr)
+			c.health.Failure(credsErr, 0)
+			return
+		}
+		c.creds = creds
+		if aws.BoolValue(c.cluster.AuthTokenEnabled) && creds.password == "" {
+			c.logger.Warning("AUTH is enabled for the cluster, but no credentials are configured")
+		}
+		scheme, host := "redis", c.ip.String()
+		if aws.BoolValue(c.cluster.TransitEncryptionEnabled) {
+			// the server certificate is issued for the node hostname, not for its IP
+			scheme, host = "rediss", aws.StringValue(c.node.Endpoint.Address)
+		}
+		address := net.JoinHostPort(host, strconv.Itoa(int(aws.Int64Value(c.node.Endpoint.Port))))
+		url := fmt.Sprintf("%s://%s", scheme, address)
+		// Valkey speaks the Redis protocol, its metrics are exported with the same names
 		opts := exporter.Options{
+			User:               creds.user,
+			Password:           creds.password,
 			Namespace:          "redis",
 			ConfigCommandName:  "CONFIG",
 			IsCluster:          false,
@@ -82,9 +177,11 @@ func (c *Collector) startMetricCollector() {
 		}
 		if collector, err := exporter.NewRedisExporter(url, opts); err != nil {
 			c.logger.Warning("failed to init redis collector:", err)
+			c.health.Failure(err, 0)
 		} else {
 			c.logger.Info("redis collector ->", url)
 			c.metricCollector = collector
+			c.redisPool = newRedisPool(address, scheme == "rediss", creds)
 		}
 	case "memcached":
 		address := fmt.Sprintf("%s:%d", c.ip.String(), aws.Int64Value(c.node.Endpoint.Port))
@@ -98,9 +195,125 @@ func (c *Collector) startMetricCollector() {
 	}
 }
 
-func (c *Collector) Close() {}
+// role returns the current role of the node in its replication group,
+// it's empty if the node isn't a member of any or the role isn't reported (cluster mode enabled)
+func (c *Collector) role() string {
+	if _, m := groupMember(c.group, aws.StringValue(c.cluster.CacheClusterId), aws.StringValue(c.node.CacheNodeId)); m != nil {
+		return aws.StringValue(m.CurrentRole)
+	}
+	return ""
+}
+
+func (c *Collector) stopMetricCollector() {
+	if c.redisPool != nil {
+		_ = c.redisPool.Close()
+		c.redisPool = nil
+	}
+	c.serverEngine, c.serverVersion = "", ""
+	c.metricCollector = nil
+}
+
+func (c *Collector) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.stopMetricCollector()
+		if c.slowlog != nil {
+			c.slowlog.Stop()
+			c.slowlog = nil
+		}
+	})
+}
+
+// collectMetrics runs the exporter and returns an error if it hasn't reached the node,
+// the agent's own connection is used to find out the reason as the exporter only logs it
+func collectMetrics(ch chan<- prometheus.Metric, collector prometheus.Collector, pool *redis.Pool, engine string) error {
+	if up, found := utils.CollectUp(collector, ch, upMetric(engine)); !found || up {
+		return nil
+	}
+	if pool != nil {
+		conn, err := getConn(pool)
+		if err != nil {
+			return err
+		}
+		_ = conn.Close()
+	}
+	return utils.ErrDown
+}
+
+// collectEngineInfo requests the engine and its version once per connection pool,
+// they change only on an upgrade, which is followed by a discovery reporting the new engine version
+func (c *Collector) collectEngineInfo(ch chan<- prometheus.Metric, pool *redis.Pool) error {
+	c.lock.Lock()
+	engine, version := c.serverEngine, c.serverVersion
+	c.lock.Unlock()
+	if engine == "" {
+		conn, err := getConn(pool)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if engine, version, err = serverInfo(conn); err != nil {
+			return err
+		}
+		c.lock.Lock()
+		if c.redisPool == pool {
+			c.serverEngine, c.serverVersion = engine, version
+		}
+		c.lock.Unlock()
+	}
+	ch <- utils.Gauge(dEngineInfo, 1, engine, version)
+	return nil
+}
+
+func pollSlowlog(pool *redis.Pool, slowlog *slowlogCollector) error {
+	conn, err := getConn(pool)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return slowlog.poll(conn)
+}
+
+// runSampler runs the rounds of keyspace sampling in the background, so the scrapes export the last results without waiting
+func (c *Collector) runSampler() {
+	t := time.NewTicker(*flags.ElasticacheBigKeysInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+		}
+		c.lock.Lock()
+		pool, clusterMode := c.redisPool, c.group != nil && aws.BoolValue(c.group.ClusterEnabled)
+		c.lock.Unlock()
+		if pool == nil {
+			continue
+		}
+		if err := c.sampleKeys(pool, clusterMode); err != nil {
+			c.logger.Warning("failed to sample keyspace:", err)
+		}
+	}
+}
+
+func (c *Collector) sampleKeys(pool *redis.Pool, clusterMode bool) error {
+	conn, err := getConn(pool)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	t := time.Now()
+	if err = c.sampler.sample(conn, clusterMode); err != nil {
+		return err
+	}
+	c.logger.Info("keyspace sampled in:", time.Since(t))
+	return nil
+}
 
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
 	ch <- utils.Gauge(dStatus, 1, aws.StringValue(c.node.CacheNodeStatus))
 
 	cluster := aws.StringValue(c.cluster.ReplicationGroupId)
@@ -119,17 +332,71 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 		aws.StringValue(c.cluster.CacheNodeType),
 		cluster,
 	)
+	ch <- utils.Counter(dFailovers, float64(c.failovers))
+	c.collectMaintenance(ch, cluster)
+
+	if ng, m := groupMember(c.group, aws.StringValue(c.cluster.CacheClusterId), aws.StringValue(c.node.CacheNodeId)); m != nil {
+		ch <- utils.Gauge(dNodeRole, 1, aws.StringValue(c.group.ReplicationGroupId), aws.StringValue(ng.NodeGroupId), nodeRole(m))
+	}
+
+	if c.sampler != nil {
+		c.sampler.collect(ch)
+	}
+	engine := aws.StringValue(c.cluster.Engine)
+	metricCollector, pool, slowlog := c.metricCollector, c.redisPool, c.slowlog
+	c.lock.Unlock()
 
-	if c.metricCollector != nil {
+	// the node is queried without holding the lock, so a slow node doesn't block the updates from the discoverer,
+	// the pool closed by an update in the meantime just fails the scrape
+	if metricCollector != nil {
 		t := time.Now()
-		c.metricCollector.Collect(ch)
+		if err := collectMetrics(ch, metricCollector, pool, engine); err != nil {
+			c.health.Failure(err, time.Since(t))
+		} else {
+			c.health.Success(time.Since(t))
+		}
 		c.logger.Info("cache metrics collected in:", time.Since(t))
 	}
+	if pool != nil {
+		if err := c.collectEngineInfo(ch, pool); err != nil {
+			c.logger.Warning("failed to get server info:", err)
+		}
+		if slowlog != nil {
+			if err := pollSlowlog(pool, slowlog); err != nil {
+				c.logger.Warning("failed to get slowlog:", err)
+			}
+		}
+	}
+	if slowlog != nil {
+		slowlog.collect(ch)
+	}
+	if isRedisProtocol(engine) {
+		collectPoolStats(ch, pool)
+	}
+	c.health.Collect(ch)
 }
 
 func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- dInfo
 	ch <- dStatus
+	ch <- dFailovers
+	ch <- dNodeRole
+	ch <- dEngineInfo
+	ch <- dOpenConnections
+	ch <- dSlowlogDuration
+	ch <- dSlowlogMessages
+	ch <- dBigKeysPrefixMemory
+	ch <- dBigKeysPrefixKeys
+	ch <- dBigKeysSampledKeys
+	ch <- dBigKeysPassComplete
+	ch <- dEvents
+	ch <- dEventLast
+	ch <- dUpdateAction
+	ch <- dUpdateApplyBy
+	ch <- dMaintenanceWindow
+	ch <- dMaintenanceNextStart
+	ch <- dMaintenanceDuration
+	utils.DescribeHealth(ch)
 }
 
 type promLogger struct {
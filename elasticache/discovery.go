@@ -8,6 +8,7 @@ import (
 	"github.com/coroot/coroot-aws-agent/utils"
 	"github.com/coroot/logger"
 	"github.com/prometheus/client_golang/prometheus"
+	"strings"
 	"time"
 )
 
@@ -17,6 +18,14 @@ type Discoverer struct {
 	awsSession *session.Session
 
 	instances map[string]*Collector
+	groups    map[string]*replicationGroupCollector
+	caches    map[string]*ServerlessCollector
+	watchers  map[string]*memcachedWatcher
+	snapshots *snapshotCollector
+
+	refreshNow chan bool
+	eventsFrom time.Time
+	seenEvents map[string]bool
 
 	logger logger.Logger
 }
@@ -26,8 +35,16 @@ func NewDiscoverer(reg prometheus.Registerer, awsSession *session.Session) *Disc
 		reg:        reg,
 		awsSession: awsSession,
 		instances:  map[string]*Collector{},
+		groups:     map[string]*replicationGroupCollector{},
+		caches:     map[string]*ServerlessCollector{},
+		watchers:   map[string]*memcachedWatcher{},
+		snapshots:  newSnapshotCollector(aws.StringValue(awsSession.Config.Region)),
+		refreshNow: make(chan bool, 1),
 		logger:     logger.NewKlog(""),
 	}
+	if err := reg.Register(d.snapshots); err != nil {
+		d.logger.Warning(err)
+	}
 	return d
 }
 
@@ -40,13 +57,25 @@ func (d *Discoverer) Run() {
 
 	ticker := time.Tick(*flags.DiscoveryInterval)
 
-	for range ticker {
+	for {
+		select {
+		case <-ticker:
+		case <-d.refreshNow:
+			d.logger.Info("refreshing clusters on a Memcached config change")
+		}
 		if err := d.refresh(api); err != nil {
 			d.logger.Warning(err)
 		}
 	}
 }
 
+func (d *Discoverer) triggerRefresh() {
+	select {
+	case d.refreshNow <- true:
+	default:
+	}
+}
+
 func (d *Discoverer) refresh(api *elasticache.ElastiCache) error {
 	t := time.Now()
 	defer func() {
@@ -54,6 +83,7 @@ func (d *Discoverer) refresh(api *elasticache.ElastiCache) error {
 	}()
 
 	var clusters []*elasticache.CacheCluster
+	clusterTags := map[string]map[string]string{}
 	var err error
 
 	for _, v := range []bool{false, true} {
@@ -86,6 +116,7 @@ func (d *Discoverer) refresh(api *elasticache.ElastiCache) error {
 					continue
 				}
 				clusters = append(clusters, cluster)
+				clusterTags[aws.StringValue(cluster.CacheClusterId)] = tags
 			}
 			if output.Marker != nil {
 				input.SetMarker(aws.StringValue(output.Marker))
@@ -95,26 +126,49 @@ func (d *Discoverer) refresh(api *elasticache.ElastiCache) error {
 		}
 	}
 
+	d.updateWatchers(clusters)
+
+	groups, err := d.describeReplicationGroups(api)
+	if err != nil {
+		d.logger.Warning("failed to describe replication groups:", err)
+	}
+
 	actualInstances := map[string]bool{}
+	actualGroups := map[string]bool{}
+	snapshots := map[string]*clusterSnapshots{}
 	for _, cluster := range clusters {
+		tags := clusterTags[aws.StringValue(cluster.CacheClusterId)]
+		group := groups[aws.StringValue(cluster.ReplicationGroupId)]
+		// Memcached doesn't support snapshots
+		redisProtocol := isRedisProtocol(aws.StringValue(cluster.Engine))
+		if group != nil {
+			d.updateGroup(group, aws.StringValue(cluster.Engine), tags)
+			actualGroups[aws.StringValue(group.ReplicationGroupId)] = true
+			if redisProtocol {
+				snapshots[aws.StringValue(group.ReplicationGroupId)] = newClusterSnapshots(group.SnapshotRetentionLimit, group.SnapshotWindow)
+			}
+		} else if cluster.ReplicationGroupId == nil && redisProtocol {
+			snapshots[aws.StringValue(cluster.CacheClusterId)] = newClusterSnapshots(cluster.SnapshotRetentionLimit, cluster.SnapshotWindow)
+		}
 		for _, node := range cluster.CacheNodes {
 			id := aws.StringValue(cluster.CacheClusterId) + "/" + aws.StringValue(node.CacheNodeId)
 			actualInstances[id] = true
 			i, ok := d.instances[id]
 			if !ok {
 				d.logger.Info("new Elasticache instance found:", id)
-				i, err = NewCollector(d.awsSession, cluster, node)
+				i, err = NewCollector(d.awsSession, cluster, node, tags)
 				if err != nil {
 					d.logger.Warning("failed to init Elasticache collector:", err)
 					continue
 				}
 				if err := d.wrappedReg(id).Register(i); err != nil {
 					d.logger.Warning(err)
+					i.Close()
 					continue
 				}
 				d.instances[id] = i
 			}
-			i.update(cluster, node)
+			i.update(cluster, node, group, tags)
 		}
 	}
 
@@ -126,10 +180,255 @@ func (d *Discoverer) refresh(api *elasticache.ElastiCache) error {
 			delete(d.instances, id)
 		}
 	}
+	for id, g := range d.groups {
+		if groups != nil && !actualGroups[id] {
+			d.logger.Info("Elasticache replication group no longer exists:", id)
+			d.wrappedGroupReg(id).Unregister(g)
+			g.Close()
+			delete(d.groups, id)
+		}
+	}
+
+	if err := d.refreshSnapshots(api, snapshots); err != nil {
+		d.logger.Warning("failed to describe snapshots:", err)
+	}
+	if err := d.refreshEvents(api); err != nil {
+		d.logger.Warning("failed to describe events:", err)
+	}
+	if err := d.refreshUpdateActions(api); err != nil {
+		d.logger.Warning("failed to describe update actions:", err)
+	}
+
+	if err := d.refreshServerless(api); err != nil {
+		d.logger.Warning("failed to discover serverless caches:", err)
+	}
 	return nil
 }
 
+func (d *Discoverer) updateWatchers(clusters []*elasticache.CacheCluster) {
+	if *flags.ElasticacheMcDiscovery <= 0 {
+		return
+	}
+	actualWatchers := map[string]bool{}
+	for _, cluster := range clusters {
+		if aws.StringValue(cluster.Engine) != "memcached" || cluster.ConfigurationEndpoint == nil {
+			continue
+		}
+		id := aws.StringValue(cluster.CacheClusterId)
+		actualWatchers[id] = true
+		w, ok := d.watchers[id]
+		if !ok || w.address != endpoint(cluster.ConfigurationEndpoint) {
+			if ok {
+				d.wrappedClusterReg(id).Unregister(w)
+				w.Stop()
+			}
+			w = newMemcachedWatcher(cluster, d.triggerRefresh)
+			if err := d.wrappedClusterReg(id).Register(w); err != nil {
+				d.logger.Warning(err)
+			}
+			d.watchers[id] = w
+		}
+		w.setApiNodes(cluster)
+	}
+	for id, w := range d.watchers {
+		if !actualWatchers[id] {
+			d.wrappedClusterReg(id).Unregister(w)
+			w.Stop()
+			delete(d.watchers, id)
+		}
+	}
+}
+
+// refreshServerless discovers ElastiCache Serverless caches, they aren't returned by DescribeCacheClusters
+func (d *Discoverer) refreshServerless(api *elasticache.ElastiCache) error {
+	var caches []*elasticache.ServerlessCache
+	err := api.DescribeServerlessCachesPages(&elasticache.DescribeServerlessCachesInput{},
+		func(output *elasticache.DescribeServerlessCachesOutput, _ bool) bool {
+			caches = append(caches, output.ServerlessCaches...)
+			return true
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	actualCaches := map[string]bool{}
+	for _, cache := range caches {
+		id := aws.StringValue(cache.ServerlessCacheName)
+		tags := map[string]string{}
+		o, err := api.ListTagsForResource(&elasticache.ListTagsForResourceInput{ResourceName: cache.ARN})
+		if err != nil {
+			d.logger.Error(err)
+		} else {
+			for _, t := range o.TagList {
+				tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+			}
+		}
+		if utils.Filtered(*flags.ElasticacheFilters, tags) {
+			d.logger.Infof("serverless cache %s (tags: %s) was skipped according to the tag-based filters: %s", id, tags, *flags.ElasticacheFilters)
+			continue
+		}
+		actualCaches[id] = true
+		c, ok := d.caches[id]
+		if !ok {
+			d.logger.Info("new Elasticache serverless cache found:", id)
+			c, err = NewServerlessCollector(d.awsSession, cache, tags)
+			if err != nil {
+				d.logger.Warning("failed to init Elasticache serverless collector:", err)
+				continue
+			}
+			if err := d.wrappedServerlessReg(id).Register(c); err != nil {
+				d.logger.Warning(err)
+				c.Close()
+				continue
+			}
+			d.caches[id] = c
+		}
+		c.update(cache, tags)
+	}
+
+	for id, c := range d.caches {
+		if !actualCaches[id] {
+			d.logger.Info("Elasticache serverless cache no longer exists:", id)
+			d.wrappedServerlessReg(id).Unregister(c)
+			c.Close()
+			delete(d.caches, id)
+		}
+	}
+	return nil
+}
+
+func (d *Discoverer) refreshSnapshots(api *elasticache.ElastiCache, clusters map[string]*clusterSnapshots) error {
+	var snapshots []*elasticache.Snapshot
+	err := api.DescribeSnapshotsPages(&elasticache.DescribeSnapshotsInput{}, func(output *elasticache.DescribeSnapshotsOutput, _ bool) bool {
+		snapshots = append(snapshots, output.Snapshots...)
+		return true
+	})
+	if err != nil {
+		// the settings come from the discovery, so they are updated anyway
+		d.snapshots.updateSettings(clusters)
+		return err
+	}
+	d.snapshots.update(clusters, snapshots)
+	return nil
+}
+
+// refreshEvents passes the events that occurred since the previous refresh to the node collectors,
+// the events that occurred before the agent started are skipped.
+// Both source types are fetched before dispatching, so a failed request doesn't lead to counting the events twice on the next try.
+// The time range is inclusive, so an event at the border may be returned again, the events of the previous range are skipped.
+func (d *Discoverer) refreshEvents(api *elasticache.ElastiCache) error {
+	now := time.Now()
+	if d.eventsFrom.IsZero() {
+		d.eventsFrom = now
+		return nil
+	}
+	var events []*elasticache.Event
+	for _, sourceType := range []string{elasticache.SourceTypeCacheCluster, elasticache.SourceTypeReplicationGroup} {
+		input := &elasticache.DescribeEventsInput{
+			SourceType: aws.String(sourceType),
+			StartTime:  aws.Time(d.eventsFrom),
+			EndTime:    aws.Time(now),
+		}
+		err := api.DescribeEventsPages(input, func(output *elasticache.DescribeEventsOutput, _ bool) bool {
+			events = append(events, output.Events...)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	seen := map[string]bool{}
+	for _, e := range events {
+		key := strings.Join([]string{
+			aws.StringValue(e.SourceType), aws.StringValue(e.SourceIdentifier), aws.TimeValue(e.Date).String(), aws.StringValue(e.Message),
+		}, "|")
+		seen[key] = true
+		if d.seenEvents[key] {
+			continue
+		}
+		d.logger.Infof("event: %s %s: %s", aws.StringValue(e.SourceType), aws.StringValue(e.SourceIdentifier), aws.StringValue(e.Message))
+		for _, i := range d.instances {
+			i.observeEvent(e)
+		}
+	}
+	d.eventsFrom, d.seenEvents = now, seen
+	return nil
+}
+
+func (d *Discoverer) refreshUpdateActions(api *elasticache.ElastiCache) error {
+	var actions []*elasticache.UpdateAction
+	input := &elasticache.DescribeUpdateActionsInput{
+		ShowNodeLevelUpdateStatus: aws.Bool(true),
+		UpdateActionStatus:        pendingUpdateStatuses,
+	}
+	err := api.DescribeUpdateActionsPages(input, func(output *elasticache.DescribeUpdateActionsOutput, _ bool) bool {
+		actions = append(actions, output.UpdateActions...)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, i := range d.instances {
+		i.setUpdateActions(actions)
+	}
+	return nil
+}
+
+func (d *Discoverer) describeReplicationGroups(api *elasticache.ElastiCache) (map[string]*elasticache.ReplicationGroup, error) {
+	res := map[string]*elasticache.ReplicationGroup{}
+	err := api.DescribeReplicationGroupsPages(&elasticache.DescribeReplicationGroupsInput{},
+		func(output *elasticache.DescribeReplicationGroupsOutput, _ bool) bool {
+			for _, g := range output.ReplicationGroups {
+				res[aws.StringValue(g.ReplicationGroupId)] = g
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (d *Discoverer) updateGroup(group *elasticache.ReplicationGroup, engine string, tags map[string]string) {
+	id := aws.StringValue(group.ReplicationGroupId)
+	g, ok := d.groups[id]
+	if !ok {
+		d.logger.Info("new Elasticache replication group found:", id)
+		g = newReplicationGroupCollector(aws.StringValue(d.awsSession.Config.Region), group)
+		if err := d.wrappedGroupReg(id).Register(g); err != nil {
+			d.logger.Warning(err)
+			return
+		}
+		d.groups[id] = g
+	}
+	var creds redisCredentials
+	if aws.BoolValue(group.ClusterEnabled) {
+		var err error
+		if creds, err = resolveRedisCredentials(d.awsSession, tags); err != nil {
+			d.logger.Warning(err)
+		}
+	}
+	g.update(group, engine, creds)
+}
+
 func (d *Discoverer) wrappedReg(instanceId string) prometheus.Registerer {
 	id := utils.IdWithRegion(aws.StringValue(d.awsSession.Config.Region), instanceId)
 	return prometheus.WrapRegistererWith(prometheus.Labels{"ec_instance_id": id}, d.reg)
 }
+
+func (d *Discoverer) wrappedGroupReg(groupId string) prometheus.Registerer {
+	id := utils.IdWithRegion(aws.StringValue(d.awsSession.Config.Region), groupId)
+	return prometheus.WrapRegistererWith(prometheus.Labels{"ec_replication_group_id": id}, d.reg)
+}
+
+func (d *Discoverer) wrappedClusterReg(clusterId string) prometheus.Registerer {
+	id := utils.IdWithRegion(aws.StringValue(d.awsSession.Config.Region), clusterId)
+	return prometheus.WrapRegistererWith(prometheus.Labels{"ec_cluster_id": id}, d.reg)
+}
+
+func (d *Discoverer) wrappedServerlessReg(cacheName string) prometheus.Registerer {
+	id := utils.IdWithRegion(aws.StringValue(d.awsSession.Config.Region), cacheName)
+	return prometheus.WrapRegistererWith(prometheus.Labels{"ec_serverless_cache_id": id}, d.reg)
+}
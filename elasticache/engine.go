@@ -0,0 +1,54 @@
+package elasticache
+
+import (
+	"github.com/coroot/coroot-aws-agent/utils"
+	"github.com/gomodule/redigo/redis"
+	"strings"
+)
+
+var dEngineInfo = utils.Desc("aws_elasticache_engine_info", "Engine and its version reported by the node", "engine", "version")
+
+// isRedisProtocol reports whether the engine is scraped with the redis exporter
+func isRedisProtocol(engine string) bool {
+	switch engine {
+	case "redis", "valkey":
+		return true
+	}
+	return false
+}
+
+// upMetric returns the name of the metric reporting whether the exporter has reached the node
+func upMetric(engine string) string {
+	if isRedisProtocol(engine) {
+		return "redis_up"
+	}
+	return "memcached_up"
+}
+
+// parseServerInfo extracts the engine and its version from the INFO server output.
+// Valkey reports its own version in valkey_version and server_name, while redis_version is kept for compatibility with Redis clients.
+func parseServerInfo(info string) (string, string) {
+	fields := map[string]string{}
+	for _, line := range strings.Split(info, "\n") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(line), ":"); ok {
+			fields[k] = v
+		}
+	}
+	if v := fields["valkey_version"]; v != "" {
+		return "valkey", v
+	}
+	engine := fields["server_name"]
+	if engine == "" {
+		engine = "redis"
+	}
+	return engine, fields["redis_version"]
+}
+
+func serverInfo(conn redis.Conn) (string, string, error) {
+	info, err := redis.String(conn.Do("INFO", "server"))
+	if err != nil {
+		return "", "", err
+	}
+	engine, version := parseServerInfo(info)
+	return engine, version, nil
+}
@@ -0,0 +1,47 @@
+package elasticache
+
+import (
+	"testing"
+)
+
+func TestParseServerInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		info    string
+		engine  string
+		version string
+	}{
+		{
+			name:    "redis",
+			info:    "# Server\r\nredis_version:7.1.0\r\nredis_mode:standalone\r\n",
+			engine:  "redis",
+			version: "7.1.0",
+		},
+		{
+			name:    "valkey",
+			info:    "# Server\r\nredis_version:7.2.4\r\nserver_name:valkey\r\nvalkey_version:8.0.1\r\n",
+			engine:  "valkey",
+			version: "8.0.1",
+		},
+		{
+			name:    "server name without its own version",
+			info:    "# Server\r\nredis_version:7.2.4\r\nserver_name:valkey\r\n",
+			engine:  "valkey",
+			version: "7.2.4",
+		},
+		{
+			name:    "empty",
+			info:    "",
+			engine:  "redis",
+			version: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine, version := parseServerInfo(tt.info)
+			if engine != tt.engine || version != tt.version {
+				t.Errorf("expected %s %s, got %s %s", tt.engine, tt.version, engine, version)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package elasticache
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/coroot/coroot-aws-agent/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const week = 7 * 24 * time.Hour
+
+var (
+	dEvents = utils.Desc("aws_elasticache_events_total", "Number of ElastiCache events related to the node by type",
+		"cluster_id", "source_type", "type")
+	dEventLast = utils.Desc("aws_elasticache_event_last_timestamp_seconds", "Timestamp of the last ElastiCache event related to the node by type",
+		"cluster_id", "source_type", "type")
+	dUpdateAction = utils.Desc("aws_elasticache_update_action_info", "Service update pending for the node",
+		"cluster_id", "service_update", "severity", "type", "status", "node_status", "sla_met")
+	dUpdateApplyBy = utils.Desc("aws_elasticache_update_action_apply_by_timestamp_seconds", "Date by which the service update is recommended to be applied",
+		"cluster_id", "service_update")
+	dMaintenanceWindow    = utils.Desc("aws_elasticache_maintenance_window_info", "Preferred maintenance window of the cluster (UTC)", "cluster_id", "window")
+	dMaintenanceNextStart = utils.Desc("aws_elasticache_maintenance_window_next_start_timestamp_seconds",
+		"Start of the next maintenance window, or of the current one if it is in progress", "cluster_id")
+	dMaintenanceDuration = utils.Desc("aws_elasticache_maintenance_window_duration_seconds", "Duration of the maintenance window", "cluster_id")
+
+	eventNodesRe = regexp.MustCompile(`(?i)\bcache nodes? ((?:\d{4}(?:,\s*)?)+)`)
+
+	// ElastiCache events have no categories unlike RDS events, so they are classified by the message
+	eventTypes = []struct {
+		typ   string
+		match string
+	}{
+		{"failover", "failover"},
+		{"node_replacement", "replace"},
+		{"service_update", "service update"},
+		{"snapshot", "snapshot"},
+		{"node_restart", "restart"},
+		{"node_recovery", "recovery"},
+		{"scaling", "scal"},
+		{"modification", "modif"},
+	}
+
+	// the statuses of the update actions that still require attention
+	pendingUpdateStatuses = aws.StringSlice([]string{
+		elasticache.UpdateActionStatusNotApplied,
+		elasticache.UpdateActionStatusWaitingToStart,
+		elasticache.UpdateActionStatusInProgress,
+		elasticache.UpdateActionStatusStopping,
+		elasticache.UpdateActionStatusStopped,
+		elasticache.UpdateActionStatusScheduling,
+		elasticache.UpdateActionStatusScheduled,
+	})
+)
+
+type eventKey struct {
+	sourceType string
+	typ        string
+}
+
+type eventStats struct {
+	count float64
+	last  time.Time
+}
+
+type updateAction struct {
+	name       string
+	severity   string
+	typ        string
+	status     string
+	nodeStatus string
+	slaMet     string
+	applyBy    *time.Time
+}
+
+func eventType(message string) string {
+	message = strings.ToLower(message)
+	for _, t := range eventTypes {
+		if strings.Contains(message, t.match) {
+			return t.typ
+		}
+	}
+	return "other"
+}
+
+// eventMatches reports whether the event relates to the node: cluster-level events mentioning particular nodes are filtered by the node ID
+func eventMatches(e *elasticache.Event, clusterId, groupId, nodeId string) bool {
+	switch aws.StringValue(e.SourceType) {
+	case elasticache.SourceTypeCacheCluster:
+		if aws.StringValue(e.SourceIdentifier) != clusterId {
+			return false
+		}
+		m := eventNodesRe.FindStringSubmatch(aws.StringValue(e.Message))
+		if m == nil {
+			return true
+		}
+		for _, id := range strings.Split(m[1], ",") {
+			if strings.TrimSpace(id) == nodeId {
+				return true
+			}
+		}
+		return false
+	case elasticache.SourceTypeReplicationGroup:
+		return groupId != "" && aws.StringValue(e.SourceIdentifier) == groupId
+	}
+	return false
+}
+
+func (c *Collector) observeEvent(e *elasticache.Event) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !eventMatches(e, aws.StringValue(c.cluster.CacheClusterId), aws.StringValue(c.cluster.ReplicationGroupId), aws.StringValue(c.node.CacheNodeId)) {
+		return
+	}
+	k := eventKey{sourceType: aws.StringValue(e.SourceType), typ: eventType(aws.StringValue(e.Message))}
+	s := c.events[k]
+	if s == nil {
+		s = &eventStats{}
+		c.events[k] = s
+	}
+	s.count++
+	if t := aws.TimeValue(e.Date); t.After(s.last) {
+		s.last = t
+	}
+}
+
+// setUpdateActions picks the update actions applicable to the node from the region-wide list
+func (c *Collector) setUpdateActions(actions []*elasticache.UpdateAction) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	clusterId, groupId, nodeId := aws.StringValue(c.cluster.CacheClusterId), aws.StringValue(c.cluster.ReplicationGroupId), aws.StringValue(c.node.CacheNodeId)
+	c.updateActions = c.updateActions[:0]
+	for _, a := range actions {
+		var nodeStatus string
+		switch {
+		case groupId != "" && aws.StringValue(a.ReplicationGroupId) == groupId:
+			for _, ng := range a.NodeGroupUpdateStatus {
+				for _, m := range ng.NodeGroupMemberUpdateStatus {
+					if aws.StringValue(m.CacheClusterId) == clusterId && aws.StringValue(m.CacheNodeId) == nodeId {
+						nodeStatus = aws.StringValue(m.NodeUpdateStatus)
+					}
+				}
+			}
+		case aws.StringValue(a.CacheClusterId) == clusterId:
+			for _, n := range a.CacheNodeUpdateStatus {
+				if aws.StringValue(n.CacheNodeId) == nodeId {
+					nodeStatus = aws.StringValue(n.NodeUpdateStatus)
+				}
+			}
+		default:
+			continue
+		}
+		c.updateActions = append(c.updateActions, updateAction{
+			name:       aws.StringValue(a.ServiceUpdateName),
+			severity:   aws.StringValue(a.ServiceUpdateSeverity),
+			typ:        aws.StringValue(a.ServiceUpdateType),
+			status:     aws.StringValue(a.UpdateActionStatus),
+			nodeStatus: nodeStatus,
+			slaMet:     aws.StringValue(a.SlaMet),
+			applyBy:    a.ServiceUpdateRecommendedApplyByDate,
+		})
+	}
+}
+
+func (c *Collector) collectMaintenance(ch chan<- prometheus.Metric, clusterId string) {
+	for k, s := range c.events {
+		ch <- utils.Counter(dEvents, s.count, clusterId, k.sourceType, k.typ)
+		ch <- utils.Gauge(dEventLast, float64(s.last.Unix()), clusterId, k.sourceType, k.typ)
+	}
+	for _, a := range c.updateActions {
+		ch <- utils.Gauge(dUpdateAction, 1, clusterId, a.name, a.severity, a.typ, a.status, a.nodeStatus, a.slaMet)
+		if a.applyBy != nil {
+			ch <- utils.Gauge(dUpdateApplyBy, float64(a.applyBy.Unix()), clusterId, a.name)
+		}
+	}
+	if window := aws.StringValue(c.cluster.PreferredMaintenanceWindow); window != "" {
+		ch <- utils.Gauge(dMaintenanceWindow, 1, clusterId, window)
+		start, duration, err := nextMaintenanceWindow(window, time.Now())
+		if err != nil {
+			c.logger.Warning(err)
+			return
+		}
+		ch <- utils.Gauge(dMaintenanceNextStart, float64(start.Unix()), clusterId)
+		ch <- utils.Gauge(dMaintenanceDuration, duration.Seconds(), clusterId)
+	}
+}
+
+// nextMaintenanceWindow parses a weekly window in the ddd:hh24:mi-ddd:hh24:mi format (UTC) and returns
+// the start of the window in progress or of the next one
+func nextMaintenanceWindow(window string, now time.Time) (time.Time, time.Duration, error) {
+	from, to, ok := strings.Cut(window, "-")
+	if !ok {
+		return time.Time{}, 0, fmt.Errorf("invalid maintenance window: %s", window)
+	}
+	start, err := weekOffset(from)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	end, err := weekOffset(to)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	duration := (end - start + week) % week
+	now = now.UTC()
+	weekStart := time.Date(now.Year(), now.Month(), now.Day()-int(now.Weekday()), 0, 0, 0, 0, time.UTC)
+	for _, s := range []time.Time{weekStart.Add(start - week), weekStart.Add(start), weekStart.Add(start + week)} {
+		if s.Add(duration).After(now) {
+			return s, duration, nil
+		}
+	}
+	return time.Time{}, 0, fmt.Errorf("invalid maintenance window: %s", window)
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// weekOffset returns the offset of ddd:hh24:mi from the beginning of the week (Sunday 00:00)
+func weekOffset(s string) (time.Duration, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(s)), ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid maintenance window boundary: %s", s)
+	}
+	day, ok := weekdays[parts[0]]
+	if !ok {
+		return 0, fmt.Errorf("invalid maintenance window day: %s", s)
+	}
+	t, err := time.Parse("15:04", parts[1]+":"+parts[2])
+	if err != nil {
+		return 0, fmt.Errorf("invalid maintenance window time: %s", s)
+	}
+	return time.Duration(day)*24*time.Hour + time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
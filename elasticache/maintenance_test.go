@@ -0,0 +1,106 @@
+package elasticache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWeekOffset(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected time.Duration
+		err      bool
+	}{
+		{s: "sun:00:00", expected: 0},
+		{s: "sun:05:30", expected: 5*time.Hour + 30*time.Minute},
+		{s: "Mon:23:00", expected: 47 * time.Hour},
+		{s: "sat:23:59", expected: 6*24*time.Hour + 23*time.Hour + 59*time.Minute},
+		{s: "sun:05", err: true},
+		{s: "xyz:05:00", err: true},
+		{s: "sun:25:00", err: true},
+	}
+	for _, tt := range tests {
+		got, err := weekOffset(tt.s)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%s: expected an error", tt.s)
+		case !tt.err && err != nil:
+			t.Errorf("%s: unexpected error: %s", tt.s, err)
+		case got != tt.expected:
+			t.Errorf("%s: expected %s, got %s", tt.s, tt.expected, got)
+		}
+	}
+}
+
+func TestNextMaintenanceWindow(t *testing.T) {
+	date := func(day, hour, min int) time.Time {
+		return time.Date(2024, time.January, day, hour, min, 0, 0, time.UTC) // 2024-01-07 is a Sunday
+	}
+	tests := []struct {
+		name     string
+		window   string
+		now      time.Time
+		start    time.Time
+		duration time.Duration
+		err      bool
+	}{
+		{
+			name:     "later this week",
+			window:   "sun:05:00-sun:06:00",
+			now:      date(3, 12, 0),
+			start:    date(7, 5, 0),
+			duration: time.Hour,
+		},
+		{
+			name:     "in progress",
+			window:   "wed:10:00-wed:11:00",
+			now:      date(3, 10, 30),
+			start:    date(3, 10, 0),
+			duration: time.Hour,
+		},
+		{
+			name:     "passed this week",
+			window:   "mon:10:00-mon:11:00",
+			now:      date(3, 12, 0),
+			start:    date(8, 10, 0),
+			duration: time.Hour,
+		},
+		{
+			name:     "spanning the end of the week, in progress",
+			window:   "sat:23:00-sun:01:00",
+			now:      date(7, 0, 30),
+			start:    date(6, 23, 0),
+			duration: 2 * time.Hour,
+		},
+		{
+			name:     "spanning the end of the week, upcoming",
+			window:   "sat:23:00-sun:01:00",
+			now:      date(7, 2, 0),
+			start:    date(13, 23, 0),
+			duration: 2 * time.Hour,
+		},
+		{
+			name:   "invalid",
+			window: "sun:05:00",
+			now:    date(3, 12, 0),
+			err:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, duration, err := nextMaintenanceWindow(tt.window, tt.now)
+			if tt.err {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !start.Equal(tt.start) || duration != tt.duration {
+				t.Errorf("expected %s for %s, got %s for %s", tt.start, tt.duration, start, duration)
+			}
+		})
+	}
+}
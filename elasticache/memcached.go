@@ -0,0 +1,230 @@
+package elasticache
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/coroot/coroot-aws-agent/flags"
+	"github.com/coroot/coroot-aws-agent/utils"
+	"github.com/coroot/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	dMcConfigUp      = utils.Desc("aws_elasticache_memcached_config_up", "Whether the node list was successfully retrieved from the configuration endpoint")
+	dMcConfigVersion = utils.Desc("aws_elasticache_memcached_config_version", "Version of the cluster configuration reported by the configuration endpoint")
+	dMcNodes         = utils.Desc("aws_elasticache_memcached_nodes", "Number of nodes in the cluster according to the engine (config get cluster) or the AWS API", "source")
+	dMcNodesMissing  = utils.Desc("aws_elasticache_memcached_nodes_missing", "Number of nodes known to one source but missing in the other one", "source")
+)
+
+// memcachedWatcher polls the configuration endpoint of a Memcached cluster with `config get cluster`
+// and triggers the discovery once the engine reports a new version of the node list.
+// The AWS API may lag behind the engine, so the discovery is retried with a backoff
+// until the API node list matches the engine one or the regular discovery interval is reached.
+type memcachedWatcher struct {
+	address string
+	tls     bool
+	trigger func()
+
+	apiNodes    []string
+	engineNodes []string
+	version     int64
+	err         error
+	retryDelay  time.Duration
+	retryAt     time.Time
+	lock        sync.Mutex
+
+	stop   chan bool
+	logger logger.Logger
+}
+
+func newMemcachedWatcher(cluster *elasticache.CacheCluster, trigger func()) *memcachedWatcher {
+	w := &memcachedWatcher{
+		address: endpoint(cluster.ConfigurationEndpoint),
+		tls:     aws.BoolValue(cluster.TransitEncryptionEnabled),
+		trigger: trigger,
+		version: -1,
+		stop:    make(chan bool),
+		logger:  logger.NewKlog(aws.StringValue(cluster.CacheClusterId)),
+	}
+	w.setApiNodes(cluster)
+	go func() {
+		t := time.NewTicker(*flags.ElasticacheMcDiscovery)
+		defer t.Stop()
+		w.poll()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-t.C:
+				w.poll()
+			}
+		}
+	}()
+	return w
+}
+
+func (w *memcachedWatcher) Stop() {
+	close(w.stop)
+}
+
+func (w *memcachedWatcher) setApiNodes(cluster *elasticache.CacheCluster) {
+	var nodes []string
+	for _, n := range cluster.CacheNodes {
+		if n.Endpoint != nil {
+			nodes = append(nodes, strings.ToLower(endpoint(n.Endpoint)))
+		}
+	}
+	sort.Strings(nodes)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.apiNodes = nodes
+}
+
+func (w *memcachedWatcher) poll() {
+	version, nodes, err := configGetCluster(w.address, w.tls)
+	w.lock.Lock()
+	prev := w.version
+	w.err = err
+	if err == nil {
+		w.version, w.engineNodes = version, nodes
+	}
+	w.lock.Unlock()
+	if err != nil {
+		w.logger.Warning("failed to get the cluster config:", err)
+		return
+	}
+	changed := prev >= 0 && version != prev
+	if changed {
+		w.logger.Infof("the cluster config has changed: version %d -> %d", prev, version)
+	}
+	if w.reconcile(time.Now(), changed) {
+		w.trigger()
+	}
+}
+
+// reconcile reports whether the discovery should be triggered
+func (w *memcachedWatcher) reconcile(now time.Time, changed bool) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if changed {
+		w.retryDelay = *flags.ElasticacheMcDiscovery
+		w.retryAt = now.Add(w.retryDelay)
+		return true
+	}
+	if w.retryDelay == 0 {
+		return false
+	}
+	if len(difference(w.engineNodes, w.apiNodes)) == 0 && len(difference(w.apiNodes, w.engineNodes)) == 0 {
+		w.retryDelay = 0
+		return false
+	}
+	if now.Before(w.retryAt) {
+		return false
+	}
+	w.retryDelay *= 2
+	if w.retryDelay >= *flags.DiscoveryInterval {
+		w.logger.Warning("the node list of the AWS API still differs from the engine one, leaving it to the regular discovery")
+		w.retryDelay = 0
+		return false
+	}
+	w.logger.Info("the node list of the AWS API differs from the engine one, retrying the discovery")
+	w.retryAt = now.Add(w.retryDelay)
+	return true
+}
+
+func (w *memcachedWatcher) Collect(ch chan<- prometheus.Metric) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	ch <- utils.Gauge(dMcNodes, float64(len(w.apiNodes)), "api")
+	if w.err != nil || w.version < 0 {
+		ch <- utils.Gauge(dMcConfigUp, 0)
+		return
+	}
+	ch <- utils.Gauge(dMcConfigUp, 1)
+	ch <- utils.Gauge(dMcConfigVersion, float64(w.version))
+	ch <- utils.Gauge(dMcNodes, float64(len(w.engineNodes)), "engine")
+	ch <- utils.Gauge(dMcNodesMissing, float64(len(difference(w.engineNodes, w.apiNodes))), "api")
+	ch <- utils.Gauge(dMcNodesMissing, float64(len(difference(w.apiNodes, w.engineNodes))), "engine")
+}
+
+func (w *memcachedWatcher) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dMcConfigUp
+	ch <- dMcConfigVersion
+	ch <- dMcNodes
+	ch <- dMcNodesMissing
+}
+
+// configGetCluster returns the config version and the host:port list of the nodes:
+// https://docs.aws.amazon.com/AmazonElastiCache/latest/mem-ug/AutoDiscovery.AddingToYourClientLibrary.html
+func configGetCluster(address string, useTLS bool) (int64, []string, error) {
+	timeout := *flags.ElasticacheConnectTimeout
+	var conn net.Conn
+	var err error
+	if useTLS {
+		host, _, _ := net.SplitHostPort(address)
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", address, &tls.Config{ServerName: host})
+	} else {
+		conn, err = net.DialTimeout("tcp", address, timeout)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if _, err = conn.Write([]byte("config get cluster\r\n")); err != nil {
+		return 0, nil, err
+	}
+	r := bufio.NewReader(conn)
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return 0, nil, err
+	}
+	if !strings.HasPrefix(header, "CONFIG cluster") {
+		return 0, nil, fmt.Errorf("unexpected response: %s", strings.TrimSpace(header))
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, nil, err
+	}
+	version, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid config version: %w", err)
+	}
+	if line, err = r.ReadString('\n'); err != nil {
+		return 0, nil, err
+	}
+	var nodes []string
+	for _, n := range strings.Fields(line) {
+		parts := strings.Split(n, "|") // hostname|ip|port
+		if len(parts) != 3 {
+			continue
+		}
+		nodes = append(nodes, strings.ToLower(net.JoinHostPort(parts[0], parts[2])))
+	}
+	sort.Strings(nodes)
+	return version, nodes, nil
+}
+
+// difference returns the elements of a that are missing in b
+func difference(a, b []string) []string {
+	set := map[string]bool{}
+	for _, s := range b {
+		set[s] = true
+	}
+	var res []string
+	for _, s := range a {
+		if !set[s] {
+			res = append(res, s)
+		}
+	}
+	return res
+}
@@ -0,0 +1,120 @@
+package elasticache
+
+import (
+	"bufio"
+	"github.com/coroot/coroot-aws-agent/flags"
+	"github.com/coroot/logger"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// serveOnce accepts a single connection, reads the command and writes the response
+func serveOnce(t *testing.T, response string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte(response))
+	}()
+	return l.Addr().String()
+}
+
+func TestConfigGetCluster(t *testing.T) {
+	*flags.ElasticacheConnectTimeout = time.Second
+	tests := []struct {
+		name     string
+		response string
+		version  int64
+		nodes    []string
+		err      bool
+	}{
+		{
+			name:     "nodes",
+			response: "CONFIG cluster 0 63\r\n12\r\nnode-2.cache.amazonaws.com|10.0.0.2|11211 Node-1.cache.amazonaws.com|10.0.0.1|11211\r\n\r\nEND\r\n",
+			version:  12,
+			nodes:    []string{"node-1.cache.amazonaws.com:11211", "node-2.cache.amazonaws.com:11211"},
+		},
+		{
+			name:     "malformed node skipped",
+			response: "CONFIG cluster 0 40\r\n3\r\nnode-1|10.0.0.1|11211 node-2|10.0.0.2\r\n\r\nEND\r\n",
+			version:  3,
+			nodes:    []string{"node-1:11211"},
+		},
+		{
+			name:     "not a configuration endpoint",
+			response: "ERROR\r\n",
+			err:      true,
+		},
+		{
+			name:     "invalid version",
+			response: "CONFIG cluster 0 10\r\nfoo\r\n",
+			err:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, nodes, err := configGetCluster(serveOnce(t, tt.response), false)
+			if tt.err {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != tt.version || !reflect.DeepEqual(nodes, tt.nodes) {
+				t.Errorf("expected %d %v, got %d %v", tt.version, tt.nodes, version, nodes)
+			}
+		})
+	}
+}
+
+func TestMemcachedReconcile(t *testing.T) {
+	*flags.ElasticacheMcDiscovery = 10 * time.Second
+	*flags.DiscoveryInterval = time.Minute
+	t0 := time.Now()
+	w := &memcachedWatcher{
+		apiNodes:    []string{"a:11211"},
+		engineNodes: []string{"a:11211", "b:11211"},
+		logger:      logger.NewKlog("test"),
+	}
+	steps := []struct {
+		after    time.Duration
+		changed  bool
+		expected bool
+	}{
+		{after: 0, changed: true, expected: true},
+		{after: 5 * time.Second, expected: false},
+		{after: 10 * time.Second, expected: true},
+		{after: 20 * time.Second, expected: false},
+		{after: 30 * time.Second, expected: true},
+		{after: 70 * time.Second, expected: false}, // the backoff has reached the discovery interval
+		{after: 200 * time.Second, expected: false},
+	}
+	for _, s := range steps {
+		if got := w.reconcile(t0.Add(s.after), s.changed); got != s.expected {
+			t.Errorf("%s: expected %v, got %v", s.after, s.expected, got)
+		}
+	}
+
+	if !w.reconcile(t0, true) {
+		t.Fatal("a config change must trigger the discovery")
+	}
+	w.apiNodes = []string{"a:11211", "b:11211"}
+	if w.reconcile(t0.Add(time.Minute), false) {
+		t.Error("the discovery must not be retried once the node lists match")
+	}
+}
@@ -0,0 +1,56 @@
+package elasticache
+
+import (
+	"github.com/coroot/coroot-aws-agent/utils"
+	"github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+const (
+	poolMaxIdle     = 2
+	poolMaxActive   = 4
+	poolIdleTimeout = 5 * time.Minute
+	poolTestIdle    = time.Minute
+)
+
+var dOpenConnections = utils.Desc("aws_elasticache_agent_open_connections", "Number of connections in the agent's own pool, the connections opened by the exporter on every scrape aren't included", "state")
+
+// newRedisPool returns a pool of connections reused across scrapes.
+// The redis exporter manages its own connections, they are opened and closed within a scrape.
+func newRedisPool(address string, useTLS bool, creds redisCredentials) *redis.Pool {
+	return &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", address, redisDialOptions(useTLS, creds)...)
+		},
+		TestOnBorrow: func(conn redis.Conn, lastUsed time.Time) error {
+			if time.Since(lastUsed) < poolTestIdle {
+				return nil
+			}
+			_, err := conn.Do("PING")
+			return err
+		},
+		MaxIdle:     poolMaxIdle,
+		MaxActive:   poolMaxActive,
+		IdleTimeout: poolIdleTimeout,
+	}
+}
+
+// getConn returns a connection from the pool, the error is returned immediately rather than on the first command
+func getConn(pool *redis.Pool) (redis.Conn, error) {
+	conn := pool.Get()
+	if err := conn.Err(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func collectPoolStats(ch chan<- prometheus.Metric, pool *redis.Pool) {
+	var s redis.PoolStats
+	if pool != nil {
+		s = pool.Stats()
+	}
+	ch <- utils.Gauge(dOpenConnections, float64(s.ActiveCount-s.IdleCount), "in_use")
+	ch <- utils.Gauge(dOpenConnections, float64(s.IdleCount), "idle")
+}
@@ -0,0 +1,173 @@
+package elasticache
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/coroot/coroot-aws-agent/utils"
+	"github.com/coroot/logger"
+	"github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	dReplicationGroupInfo = utils.Desc("aws_elasticache_replication_group_info", "Elasticache replication group info",
+		"region", "engine", "cluster_enabled", "automatic_failover", "multi_az",
+		"primary_endpoint", "reader_endpoint", "configuration_endpoint",
+	)
+	dReplicationGroupStatus = utils.Desc("aws_elasticache_replication_group_status", "Status of the Elasticache replication group", "status")
+	dShardStatus            = utils.Desc("aws_elasticache_shard_status", "Status of the shard (node group)", "shard", "status")
+	dShardNodes             = utils.Desc("aws_elasticache_shard_nodes", "Number of nodes in the shard (node group) by role", "shard", "role")
+	dNodeRole               = utils.Desc("aws_elasticache_node_role", "Role of the node in its replication group", "replication_group_id", "shard", "role")
+)
+
+// replicationGroupCollector exports the topology of a replication group discovered via DescribeReplicationGroups
+type replicationGroupCollector struct {
+	region string
+	engine string
+	group  elasticache.ReplicationGroup
+	creds  redisCredentials
+	lock   sync.Mutex
+	logger logger.Logger
+
+	pool        *redis.Pool
+	poolAddress string
+	poolTLS     bool
+	poolCreds   redisCredentials
+}
+
+func newReplicationGroupCollector(region string, group *elasticache.ReplicationGroup) *replicationGroupCollector {
+	return &replicationGroupCollector{region: region, group: *group, logger: logger.NewKlog(aws.StringValue(group.ReplicationGroupId))}
+}
+
+func (c *replicationGroupCollector) update(group *elasticache.ReplicationGroup, engine string, creds redisCredentials) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.group = *group
+	c.engine = engine
+	c.creds = creds
+
+	address, useTLS := "", aws.BoolValue(group.TransitEncryptionEnabled)
+	if aws.BoolValue(group.ClusterEnabled) {
+		address = endpoint(group.ConfigurationEndpoint)
+	}
+	if c.pool != nil && (address != c.poolAddress || useTLS != c.poolTLS || creds != c.poolCreds) {
+		c.closePool()
+	}
+	if c.pool == nil && address != "" {
+		c.pool = newRedisPool(address, useTLS, creds)
+		c.poolAddress, c.poolTLS, c.poolCreds = address, useTLS, creds
+	}
+}
+
+func (c *replicationGroupCollector) closePool() {
+	if c.pool != nil {
+		_ = c.pool.Close()
+		c.pool = nil
+	}
+}
+
+func (c *replicationGroupCollector) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closePool()
+}
+
+func (c *replicationGroupCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	g, engine, pool := c.group, c.engine, c.pool
+	c.lock.Unlock()
+
+	var primaryEndpoint, readerEndpoint string
+	if !aws.BoolValue(g.ClusterEnabled) && len(g.NodeGroups) > 0 {
+		primaryEndpoint = endpoint(g.NodeGroups[0].PrimaryEndpoint)
+		readerEndpoint = endpoint(g.NodeGroups[0].ReaderEndpoint)
+	}
+	ch <- utils.Gauge(dReplicationGroupInfo, 1,
+		c.region,
+		engine,
+		strconv.FormatBool(aws.BoolValue(g.ClusterEnabled)),
+		aws.StringValue(g.AutomaticFailover),
+		aws.StringValue(g.MultiAZ),
+		primaryEndpoint,
+		readerEndpoint,
+		endpoint(g.ConfigurationEndpoint),
+	)
+	ch <- utils.Gauge(dReplicationGroupStatus, 1, aws.StringValue(g.Status))
+
+	for _, ng := range g.NodeGroups {
+		shard := aws.StringValue(ng.NodeGroupId)
+		ch <- utils.Gauge(dShardStatus, 1, shard, aws.StringValue(ng.Status))
+		// the roles are reported only for the groups with the cluster mode disabled
+		nodes := map[string]int{}
+		if !aws.BoolValue(g.ClusterEnabled) {
+			nodes["primary"], nodes["replica"] = 0, 0
+		}
+		for _, m := range ng.NodeGroupMembers {
+			nodes[nodeRole(m)]++
+		}
+		for role, n := range nodes {
+			ch <- utils.Gauge(dShardNodes, float64(n), shard, role)
+		}
+	}
+
+	// CLUSTER INFO and CLUSTER SHARDS describe the whole cluster, so they are collected once per group rather than per node.
+	// The commands are sent without holding the lock, so a slow cluster doesn't block the updates from the discoverer,
+	// the pool closed by an update in the meantime just fails the scrape.
+	if aws.BoolValue(g.ClusterEnabled) {
+		t := time.Now()
+		if err := collectCluster(ch, pool, &g); err != nil {
+			c.logger.Warning("failed to collect cluster state:", err)
+			ch <- utils.Gauge(dClusterUp, 0)
+		}
+		c.logger.Info("cluster state collected in:", time.Since(t))
+		collectPoolStats(ch, pool)
+	}
+}
+
+func (c *replicationGroupCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dReplicationGroupInfo
+	ch <- dReplicationGroupStatus
+	ch <- dShardStatus
+	ch <- dShardNodes
+	ch <- dClusterUp
+	ch <- dClusterState
+	ch <- dClusterSlots
+	ch <- dClusterKnownNodes
+	ch <- dClusterSize
+	ch <- dShardSlots
+	ch <- dShardNodeHealth
+	ch <- dOpenConnections
+}
+
+// groupMember returns the shard the node belongs to and its description
+func groupMember(group *elasticache.ReplicationGroup, clusterId, nodeId string) (*elasticache.NodeGroup, *elasticache.NodeGroupMember) {
+	if group == nil {
+		return nil, nil
+	}
+	for _, ng := range group.NodeGroups {
+		for _, m := range ng.NodeGroupMembers {
+			if aws.StringValue(m.CacheClusterId) == clusterId && aws.StringValue(m.CacheNodeId) == nodeId {
+				return ng, m
+			}
+		}
+	}
+	return nil, nil
+}
+
+func nodeRole(m *elasticache.NodeGroupMember) string {
+	if role := aws.StringValue(m.CurrentRole); role != "" {
+		return role
+	}
+	return "unknown"
+}
+
+func endpoint(e *elasticache.Endpoint) string {
+	if e == nil || e.Address == nil {
+		return ""
+	}
+	return net.JoinHostPort(aws.StringValue(e.Address), strconv.Itoa(int(aws.Int64Value(e.Port))))
+}
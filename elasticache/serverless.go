@@ -0,0 +1,308 @@
+package elasticache
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/coroot/coroot-aws-agent/flags"
+	"github.com/coroot/coroot-aws-agent/utils"
+	"github.com/coroot/logger"
+	"github.com/oliver006/redis_exporter/exporter"
+	"github.com/prometheus/client_golang/prometheus"
+	mcExporter "github.com/prometheus/memcached_exporter/pkg/exporter"
+	"sync"
+	"time"
+)
+
+const (
+	cloudWatchPeriod          = time.Minute
+	cloudWatchRefreshInterval = time.Minute
+)
+
+var (
+	dServerlessInfo = utils.Desc("aws_elasticache_serverless_info", "Elasticache Serverless cache info",
+		"region", "endpoint", "reader_endpoint", "engine", "engine_version",
+	)
+	dServerlessStatus           = utils.Desc("aws_elasticache_serverless_status", "Status of the Elasticache Serverless cache", "status")
+	dServerlessDataStorageLimit = utils.Desc("aws_elasticache_serverless_data_storage_limit_bytes", "Data storage usage limit of the cache", "limit")
+	dServerlessECPULimit        = utils.Desc("aws_elasticache_serverless_ecpu_per_second_limit", "ElastiCache Processing Units per second usage limit of the cache", "limit")
+	dServerlessBytesUsed        = utils.Desc("aws_elasticache_serverless_bytes_used", "Amount of data stored in the cache according to the BytesUsedForCache CloudWatch metric")
+	dServerlessECPU             = utils.Desc("aws_elasticache_serverless_processing_units_per_second", "ElastiCache Processing Units consumed per second according to the ElastiCacheProcessingUnits CloudWatch metric")
+)
+
+// ServerlessCollector collects the metrics of an ElastiCache Serverless cache: the engine metrics are scraped through the cache endpoint,
+// the usage is taken from CloudWatch as serverless caches don't expose node-level details
+type ServerlessCollector struct {
+	sess  *session.Session
+	cwApi *cloudwatch.CloudWatch
+
+	cache elasticache.ServerlessCache
+	tags  map[string]string
+	creds redisCredentials
+
+	metricCollector prometheus.Collector
+	health          *utils.Health
+
+	bytesUsed *float64
+	ecpu      *float64
+
+	lock      sync.Mutex
+	stop      chan bool
+	closeOnce sync.Once
+	logger    logger.Logger
+}
+
+func NewServerlessCollector(sess *session.Session, cache *elasticache.ServerlessCache, tags map[string]string) (*ServerlessCollector, error) {
+	if cache.Endpoint == nil || cache.Endpoint.Address == nil {
+		return nil, fmt.Errorf("endpoint is not defined")
+	}
+	c := &ServerlessCollector{
+		sess:   sess,
+		cwApi:  cloudwatch.New(sess),
+		cache:  *cache,
+		tags:   tags,
+		health: utils.NewHealth("cache"),
+		stop:   make(chan bool),
+		logger: logger.NewKlog(aws.StringValue(cache.ServerlessCacheName)),
+	}
+	var creds redisCredentials
+	var credsErr error
+	if aws.StringValue(cache.Engine) != "memcached" {
+		creds, credsErr = resolveRedisCredentials(sess, tags)
+	}
+	c.startMetricCollector(creds, credsErr)
+	go c.runCloudWatch()
+	return c, nil
+}
+
+// runCloudWatch refreshes the CloudWatch metrics in the background, so the scrapes don't wait for the API
+func (c *ServerlessCollector) runCloudWatch() {
+	t := time.NewTicker(cloudWatchRefreshInterval)
+	defer t.Stop()
+	for {
+		if err := c.refreshCloudWatchMetrics(); err != nil {
+			c.logger.Warning("failed to get CloudWatch metrics:", err)
+		}
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (c *ServerlessCollector) update(cache *elasticache.ServerlessCache, tags map[string]string) {
+	// the secret is fetched before locking, so it doesn't delay the scrapes
+	var creds redisCredentials
+	var credsErr error
+	if aws.StringValue(cache.Engine) != "memcached" {
+		creds, credsErr = resolveRedisCredentials(c.sess, tags)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	endpointChanged := endpoint(cache.Endpoint) != endpoint(c.cache.Endpoint)
+	c.cache = *cache
+	c.tags = tags
+	credsChanged := false
+	if credsErr != nil {
+		c.logger.Warning(credsErr)
+	} else {
+		credsChanged = creds != c.creds
+	}
+	switch {
+	case endpointChanged:
+		c.logger.Info("the endpoint has changed, restarting the collector:", endpoint(cache.Endpoint))
+		c.startMetricCollector(creds, credsErr)
+	case credsChanged:
+		c.logger.Info("the credentials have changed, restarting the collector")
+		c.startMetricCollector(creds, credsErr)
+	case !c.health.Up() && c.health.RetryDue():
+		c.logger.Info("retrying to init the collector")
+		c.startMetricCollector(creds, credsErr)
+	}
+}
+
+// startMetricCollector (re)starts the exporter, the credentials are resolved by the caller and used only for Redis and Valkey
+func (c *ServerlessCollector) startMetricCollector(creds redisCredentials, credsErr error) {
+	c.stopMetricCollector()
+	address := endpoint(c.cache.Endpoint)
+	if address == "" {
+		return
+	}
+	// serverless caches accept TLS connections only
+	switch aws.StringValue(c.cache.Engine) {
+	case "memcached":
+		c.metricCollector = mcExporter.New(
+			address,
+			*flags.ElasticacheConnectTimeout,
+			&promLogger{c.logger},
+			&tls.Config{ServerName: aws.StringValue(c.cache.Endpoint.Address)},
+		)
+		c.logger.Info("memcached collector ->", address)
+	default:
+		if credsErr != nil {
+			c.logger.Warning("failed to get redis credentials:", credsErr)
+			c.health.Failure(credsErr, 0)
+			return
+		}
+		c.creds = creds
+		url := "rediss://" + address
+		opts := exporter.Options{
+			User:               creds.user,
+			Password:           creds.password,
+			Namespace:          "redis",
+			ConfigCommandName:  "CONFIG",
+			IsCluster:          false,
+			ConnectionTimeouts: *flags.ElasticacheConnectTimeout,
+			RedisMetricsOnly:   true,
+		}
+		if collector, err := exporter.NewRedisExporter(url, opts); err != nil {
+			c.logger.Warning("failed to init redis collector:", err)
+			c.health.Failure(err, 0)
+		} else {
+			c.logger.Info("redis collector ->", url)
+			c.metricCollector = collector
+		}
+	}
+}
+
+// stopMetricCollector drops the exporter, it doesn't keep connections open between scrapes since it connects on every scrape
+func (c *ServerlessCollector) stopMetricCollector() {
+	c.metricCollector = nil
+}
+
+func (c *ServerlessCollector) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.stopMetricCollector()
+	})
+}
+
+func (c *ServerlessCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	cache := c.cache
+
+	ch <- utils.Gauge(dServerlessStatus, 1, aws.StringValue(cache.Status))
+	ch <- utils.Gauge(dServerlessInfo, 1,
+		aws.StringValue(c.sess.Config.Region),
+		endpoint(cache.Endpoint),
+		endpoint(cache.ReaderEndpoint),
+		aws.StringValue(cache.Engine),
+		aws.StringValue(cache.FullEngineVersion),
+	)
+	if l := cache.CacheUsageLimits; l != nil {
+		if ds := l.DataStorage; ds != nil {
+			unit := dataStorageUnit(aws.StringValue(ds.Unit))
+			if ds.Minimum != nil {
+				ch <- utils.Gauge(dServerlessDataStorageLimit, float64(aws.Int64Value(ds.Minimum))*unit, "min")
+			}
+			if ds.Maximum != nil {
+				ch <- utils.Gauge(dServerlessDataStorageLimit, float64(aws.Int64Value(ds.Maximum))*unit, "max")
+			}
+		}
+		if ecpu := l.ECPUPerSecond; ecpu != nil {
+			if ecpu.Minimum != nil {
+				ch <- utils.Gauge(dServerlessECPULimit, float64(aws.Int64Value(ecpu.Minimum)), "min")
+			}
+			if ecpu.Maximum != nil {
+				ch <- utils.Gauge(dServerlessECPULimit, float64(aws.Int64Value(ecpu.Maximum)), "max")
+			}
+		}
+	}
+
+	if c.bytesUsed != nil {
+		ch <- utils.Gauge(dServerlessBytesUsed, *c.bytesUsed)
+	}
+	if c.ecpu != nil {
+		ch <- utils.Gauge(dServerlessECPU, *c.ecpu)
+	}
+	metricCollector := c.metricCollector
+	c.lock.Unlock()
+
+	// the cache is queried without holding the lock, so a slow endpoint doesn't block the updates from the discoverer
+	if metricCollector != nil {
+		t := time.Now()
+		if up, found := utils.CollectUp(metricCollector, ch, upMetric(aws.StringValue(cache.Engine))); found && !up {
+			c.health.Failure(utils.ErrDown, time.Since(t))
+		} else {
+			c.health.Success(time.Since(t))
+		}
+		c.logger.Info("cache metrics collected in:", time.Since(t))
+	}
+	c.health.Collect(ch)
+}
+
+// refreshCloudWatchMetrics fetches the latest datapoints, they are cached as CloudWatch charges per request
+func (c *ServerlessCollector) refreshCloudWatchMetrics() error {
+	c.lock.Lock()
+	name := c.cache.ServerlessCacheName
+	c.lock.Unlock()
+	now := time.Now()
+	query := func(id, metric, stat string) *cloudwatch.MetricDataQuery {
+		return &cloudwatch.MetricDataQuery{
+			Id: aws.String(id),
+			MetricStat: &cloudwatch.MetricStat{
+				Metric: &cloudwatch.Metric{
+					Namespace:  aws.String("AWS/ElastiCache"),
+					MetricName: aws.String(metric),
+					Dimensions: []*cloudwatch.Dimension{{Name: aws.String("clusterId"), Value: name}},
+				},
+				Period: aws.Int64(int64(cloudWatchPeriod.Seconds())),
+				Stat:   aws.String(stat),
+			},
+		}
+	}
+	out, err := c.cwApi.GetMetricData(&cloudwatch.GetMetricDataInput{
+		StartTime: aws.Time(now.Add(-5 * cloudWatchPeriod)),
+		EndTime:   aws.Time(now),
+		ScanBy:    aws.String(cloudwatch.ScanByTimestampDescending),
+		MetricDataQueries: []*cloudwatch.MetricDataQuery{
+			query("bytes", "BytesUsedForCache", cloudwatch.StatisticMaximum),
+			query("ecpu", "ElastiCacheProcessingUnits", cloudwatch.StatisticSum),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bytesUsed, c.ecpu = nil, nil
+	for _, r := range out.MetricDataResults {
+		if len(r.Values) == 0 {
+			continue
+		}
+		v := aws.Float64Value(r.Values[0]) // the latest datapoint
+		switch aws.StringValue(r.Id) {
+		case "bytes":
+			c.bytesUsed = &v
+		case "ecpu":
+			v /= cloudWatchPeriod.Seconds()
+			c.ecpu = &v
+		}
+	}
+	return nil
+}
+
+func (c *ServerlessCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dServerlessInfo
+	ch <- dServerlessStatus
+	ch <- dServerlessDataStorageLimit
+	ch <- dServerlessECPULimit
+	ch <- dServerlessBytesUsed
+	ch <- dServerlessECPU
+	utils.DescribeHealth(ch)
+}
+
+func dataStorageUnit(unit string) float64 {
+	switch unit {
+	case elasticache.DataStorageUnitGb:
+		return 1e9
+	}
+	return 1
+}
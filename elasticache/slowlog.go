@@ -0,0 +1,203 @@
+package elasticache
+
+import (
+	"github.com/coroot/coroot-aws-agent/utils"
+	"github.com/coroot/logparser"
+	"github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	slowlogBatch       = 128 // the default value of slowlog-max-len
+	slowlogMaxArgs     = 8
+	slowlogMaxCommands = 100
+	slowlogOther       = "<other>"
+)
+
+var (
+	dSlowlogDuration = utils.Desc("aws_elasticache_slowlog_duration_seconds", "Execution time of the commands logged to SLOWLOG", "command")
+	dSlowlogMessages = utils.Desc("aws_elasticache_slowlog_messages_total",
+		"Number of SLOWLOG entries grouped by the automatically extracted repeated pattern",
+		"level", "pattern_hash", "sample")
+
+	slowlogBuckets = []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	// the commands that are logged along with their subcommand, e.g. CONFIG GET
+	containerCommands = map[string]bool{
+		"ACL": true, "CLIENT": true, "CLUSTER": true, "COMMAND": true, "CONFIG": true, "FUNCTION": true, "LATENCY": true,
+		"MEMORY": true, "MODULE": true, "OBJECT": true, "PUBSUB": true, "SCRIPT": true, "SLOWLOG": true, "XGROUP": true, "XINFO": true,
+	}
+)
+
+type slowlogEntry struct {
+	id        int64
+	timestamp int64
+	duration  time.Duration
+	args      []string
+}
+
+type slowlogStat struct {
+	count   uint64
+	sum     float64
+	buckets []uint64
+}
+
+func (stat *slowlogStat) histogram(labels ...string) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(slowlogBuckets))
+	for i, b := range slowlogBuckets {
+		buckets[b] = stat.buckets[i]
+	}
+	return utils.Histogram(dSlowlogDuration, stat.count, stat.sum, buckets, labels...)
+}
+
+// slowlogCollector polls SLOWLOG GET and feeds the normalized commands to the log parser.
+// Only the entries logged after the first poll are counted, the latest seen entry is tracked between polls.
+// The number of commands is limited, the ones beyond the limit are accounted as <other>.
+type slowlogCollector struct {
+	lastId   int64
+	lastTime int64
+	stats    map[string]*slowlogStat
+	entries  chan logparser.LogEntry
+	parser   *logparser.Parser
+	lock     sync.Mutex
+}
+
+func newSlowlogCollector() *slowlogCollector {
+	s := &slowlogCollector{
+		lastId:  -1,
+		stats:   map[string]*slowlogStat{},
+		entries: make(chan logparser.LogEntry, slowlogBatch),
+	}
+	s.parser = logparser.NewParser(s.entries, nil)
+	return s
+}
+
+func (s *slowlogCollector) Stop() {
+	s.parser.Stop()
+}
+
+func (s *slowlogCollector) poll(conn redis.Conn) error {
+	reply, err := redis.Values(conn.Do("SLOWLOG", "GET", slowlogBatch))
+	if err != nil {
+		return err
+	}
+	entries := parseSlowlog(reply) // the latest entry goes first
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(entries) == 0 {
+		if s.lastId < 0 {
+			s.lastId = 0
+		}
+		return nil
+	}
+	first := s.lastId < 0
+	// the IDs start over after a restart of the node or SLOWLOG RESET, so an entry with the same ID may be another one.
+	// If the latest seen entry isn't in the batch, the log has been reset or more entries have been logged than fetched,
+	// all the entries of the batch are new in both cases.
+	unseen := len(entries)
+	for i, e := range entries {
+		if e.id == s.lastId && e.timestamp == s.lastTime {
+			unseen = i
+			break
+		}
+	}
+	s.lastId, s.lastTime = entries[0].id, entries[0].timestamp
+	if first {
+		return nil
+	}
+	for i := unseen - 1; i >= 0; i-- {
+		e := entries[i]
+		command, content := normalizeCommand(e.args)
+		if command == "" {
+			continue
+		}
+		s.observe(command, e.duration)
+		// the entry isn't passed to the parser if it falls behind, the polling must not block
+		select {
+		case s.entries <- logparser.LogEntry{Content: content, Level: logparser.LevelWarning}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (s *slowlogCollector) observe(command string, d time.Duration) {
+	stat := s.stats[command]
+	if stat == nil {
+		if len(s.stats) >= slowlogMaxCommands {
+			command = slowlogOther
+			stat = s.stats[command]
+		}
+		if stat == nil {
+			stat = &slowlogStat{buckets: make([]uint64, len(slowlogBuckets))}
+			s.stats[command] = stat
+		}
+	}
+	v := d.Seconds()
+	stat.count++
+	stat.sum += v
+	for i, b := range slowlogBuckets {
+		if v <= b {
+			stat.buckets[i]++
+		}
+	}
+}
+
+func (s *slowlogCollector) collect(ch chan<- prometheus.Metric) {
+	s.lock.Lock()
+	for command, stat := range s.stats {
+		ch <- stat.histogram(command)
+	}
+	s.lock.Unlock()
+	for _, c := range s.parser.GetCounters() {
+		ch <- utils.Counter(dSlowlogMessages, float64(c.Messages), c.Level.String(), c.Hash, c.Sample)
+	}
+}
+
+// parseSlowlog parses the reply of SLOWLOG GET: id, timestamp, duration in microseconds, arguments, and optionally client address and name
+func parseSlowlog(reply []interface{}) []slowlogEntry {
+	var res []slowlogEntry
+	for _, item := range reply {
+		fields, _ := redis.Values(item, nil)
+		if len(fields) < 4 {
+			continue
+		}
+		id, err1 := redis.Int64(fields[0], nil)
+		ts, err2 := redis.Int64(fields[1], nil)
+		us, err3 := redis.Int64(fields[2], nil)
+		args, err4 := redis.Strings(fields[3], nil)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			continue
+		}
+		res = append(res, slowlogEntry{id: id, timestamp: ts, duration: time.Duration(us) * time.Microsecond, args: args})
+	}
+	return res
+}
+
+// normalizeCommand returns the command name and the command with its arguments replaced with placeholders,
+// the arguments may contain sensitive data and make every entry unique
+func normalizeCommand(args []string) (string, string) {
+	if len(args) == 0 {
+		return "", ""
+	}
+	command := strings.ToUpper(args[0])
+	args = args[1:]
+	if containerCommands[command] && len(args) > 0 {
+		command += " " + strings.ToUpper(args[0])
+		args = args[1:]
+	}
+	var b strings.Builder
+	b.WriteString(command)
+	for i := range args {
+		if i == slowlogMaxArgs {
+			b.WriteString(" ...")
+			break
+		}
+		b.WriteString(" ?")
+	}
+	return command, b.String()
+}
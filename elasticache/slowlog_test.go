@@ -0,0 +1,93 @@
+package elasticache
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"testing"
+)
+
+func TestNormalizeCommand(t *testing.T) {
+	tests := []struct {
+		args    []string
+		command string
+		content string
+	}{
+		{args: nil, command: "", content: ""},
+		{args: []string{"ping"}, command: "PING", content: "PING"},
+		{args: []string{"get", "user:1"}, command: "GET", content: "GET ?"},
+		{args: []string{"config", "get", "maxmemory"}, command: "CONFIG GET", content: "CONFIG GET ?"},
+		{args: []string{"CLIENT"}, command: "CLIENT", content: "CLIENT"},
+		{args: []string{"MSET", "a", "1", "b", "2", "c", "3", "d", "4", "e", "5"}, command: "MSET", content: "MSET ? ? ? ? ? ? ? ? ..."},
+	}
+	for _, tt := range tests {
+		command, content := normalizeCommand(tt.args)
+		if command != tt.command || content != tt.content {
+			t.Errorf("%v: expected %q, %q, got %q, %q", tt.args, tt.command, tt.content, command, content)
+		}
+	}
+}
+
+// slowlogConn replies to SLOWLOG GET with the entries given as id, timestamp pairs, the latest first
+type slowlogConn struct {
+	redis.Conn
+	entries [][2]int64
+}
+
+func (c *slowlogConn) Do(string, ...interface{}) (interface{}, error) {
+	var reply []interface{}
+	for _, e := range c.entries {
+		reply = append(reply, []interface{}{e[0], e[1], int64(20000), []interface{}{[]byte("GET"), []byte("key")}})
+	}
+	return reply, nil
+}
+
+func TestSlowlogPoll(t *testing.T) {
+	tests := []struct {
+		name     string
+		polls    [][][2]int64
+		expected uint64
+	}{
+		{
+			name:     "entries before the first poll are skipped",
+			polls:    [][][2]int64{{{2, 100}, {1, 90}}},
+			expected: 0,
+		},
+		{
+			name:     "new entries",
+			polls:    [][][2]int64{{{2, 100}, {1, 90}}, {{4, 120}, {3, 110}, {2, 100}, {1, 90}}},
+			expected: 2,
+		},
+		{
+			name:     "reset",
+			polls:    [][][2]int64{{{2, 100}, {1, 90}}, {{0, 130}}},
+			expected: 1,
+		},
+		{
+			name:     "reset followed by more entries than before",
+			polls:    [][][2]int64{{{1, 100}, {0, 90}}, {{2, 150}, {1, 140}, {0, 130}}},
+			expected: 3,
+		},
+		{
+			name:     "empty log",
+			polls:    [][][2]int64{{}, {{0, 100}}},
+			expected: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSlowlogCollector()
+			defer s.Stop()
+			for _, entries := range tt.polls {
+				if err := s.poll(&slowlogConn{entries: entries}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var count uint64
+			if stat := s.stats["GET"]; stat != nil {
+				count = stat.count
+			}
+			if count != tt.expected {
+				t.Errorf("expected %d entries, got %d", tt.expected, count)
+			}
+		})
+	}
+}
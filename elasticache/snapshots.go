@@ -0,0 +1,137 @@
+package elasticache
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/coroot/coroot-aws-agent/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+var (
+	dSnapshotRetentionLimit = utils.Desc("aws_elasticache_snapshot_retention_limit_days", "Number of days automatic snapshots are retained for (0 if automatic backups are disabled)", "region", "cluster_id")
+	dSnapshotWindow         = utils.Desc("aws_elasticache_snapshot_window_info", "Daily time range (UTC) during which automatic snapshots are taken", "region", "cluster_id", "window")
+	dSnapshots              = utils.Desc("aws_elasticache_snapshots", "Number of snapshots by source", "region", "cluster_id", "source")
+	dSnapshotLatestAge      = utils.Desc("aws_elasticache_snapshot_latest_age_seconds", "Time since the latest snapshot was created", "region", "cluster_id", "source")
+	dSnapshotLatestStatus   = utils.Desc("aws_elasticache_snapshot_latest_status", "Status of the latest snapshot", "region", "cluster_id", "source", "status")
+)
+
+type latestSnapshot struct {
+	status  string
+	created time.Time // zero while the snapshot is being created
+}
+
+type clusterSnapshots struct {
+	retentionLimit int64
+	window         string
+	count          map[string]int
+	latest         map[string]*latestSnapshot
+}
+
+func newClusterSnapshots(retentionLimit *int64, window *string) *clusterSnapshots {
+	return &clusterSnapshots{
+		retentionLimit: aws.Int64Value(retentionLimit),
+		window:         aws.StringValue(window),
+		count:          map[string]int{},
+		latest:         map[string]*latestSnapshot{},
+	}
+}
+
+// snapshotCollector exports the snapshots of the discovered clusters by the cluster_id used in aws_elasticache_info:
+// the ID of the replication group or of the cluster if it isn't a member of a group
+type snapshotCollector struct {
+	region   string
+	clusters map[string]*clusterSnapshots
+	lock     sync.Mutex
+}
+
+func newSnapshotCollector(region string) *snapshotCollector {
+	return &snapshotCollector{region: region, clusters: map[string]*clusterSnapshots{}}
+}
+
+func (c *snapshotCollector) update(clusters map[string]*clusterSnapshots, snapshots []*elasticache.Snapshot) {
+	for _, s := range snapshots {
+		id := aws.StringValue(s.ReplicationGroupId)
+		if id == "" {
+			id = aws.StringValue(s.CacheClusterId)
+		}
+		cs := clusters[id]
+		if cs == nil {
+			continue
+		}
+		source := aws.StringValue(s.SnapshotSource)
+		cs.count[source]++
+		created := snapshotCreateTime(s)
+		if l := cs.latest[source]; l == nil || newer(created, l.created) {
+			cs.latest[source] = &latestSnapshot{status: aws.StringValue(s.SnapshotStatus), created: created}
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.clusters = clusters
+}
+
+// updateSettings replaces the retention limit and the window of the clusters keeping their snapshots from the previous update,
+// it's used when the snapshots can't be listed
+func (c *snapshotCollector) updateSettings(clusters map[string]*clusterSnapshots) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for id, cs := range clusters {
+		if prev := c.clusters[id]; prev != nil {
+			cs.count, cs.latest = prev.count, prev.latest
+		}
+	}
+	c.clusters = clusters
+}
+
+// snapshotCreateTime returns the time of the latest node snapshot, a snapshot of a sharded group consists of a snapshot per shard
+func snapshotCreateTime(s *elasticache.Snapshot) time.Time {
+	var res time.Time
+	for _, n := range s.NodeSnapshots {
+		if t := aws.TimeValue(n.SnapshotCreateTime); t.After(res) {
+			res = t
+		}
+	}
+	return res
+}
+
+// newer compares the creation times of snapshots, the snapshot being created is the newest one
+func newer(a, b time.Time) bool {
+	switch {
+	case b.IsZero():
+		return false
+	case a.IsZero():
+		return true
+	}
+	return a.After(b)
+}
+
+func (c *snapshotCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	for id, cs := range c.clusters {
+		ch <- utils.Gauge(dSnapshotRetentionLimit, float64(cs.retentionLimit), c.region, id)
+		if cs.window != "" {
+			ch <- utils.Gauge(dSnapshotWindow, 1, c.region, id, cs.window)
+		}
+		for source, n := range cs.count {
+			ch <- utils.Gauge(dSnapshots, float64(n), c.region, id, source)
+		}
+		for source, l := range cs.latest {
+			ch <- utils.Gauge(dSnapshotLatestStatus, 1, c.region, id, source, l.status)
+			if !l.created.IsZero() {
+				ch <- utils.Gauge(dSnapshotLatestAge, now.Sub(l.created).Seconds(), c.region, id, source)
+			}
+		}
+	}
+}
+
+func (c *snapshotCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dSnapshotRetentionLimit
+	ch <- dSnapshotWindow
+	ch <- dSnapshots
+	ch <- dSnapshotLatestAge
+	ch <- dSnapshotLatestStatus
+}
@@ -3,16 +3,44 @@ package flags
 import "gopkg.in/alecthomas/kingpin.v2"
 
 var (
-	AwsRegion                 = kingpin.Flag("aws-region", "AWS region (env: AWS_REGION)").Envar("AWS_REGION").Required().String()
-	DiscoveryInterval         = kingpin.Flag("discovery-interval", "discovery interval").Default("60s").Duration()
-	RdsDbUser                 = kingpin.Flag("rds-db-user", "RDS db user (env: RDS_DB_USER)").Envar("RDS_DB_USER").String()
-	RdsDbPassword             = kingpin.Flag("rds-db-password", "RDS db password (env: RDS_DB_PASSWORD)").Envar("RDS_DB_PASSWORD").String()
-	RdsDbConnectTimeout       = kingpin.Flag("rds-db-connect-timeout", "RDS db connect timeout").Default("1s").Duration()
-	RdsDbQueryTimeout         = kingpin.Flag("rds-db-query-timeout", "RDS db query timeout").Default("30s").Duration()
-	RdsLogsScrapeInterval     = kingpin.Flag("rds-logs-scrape-interval", "RDS logs scrape interval (0 to disable)").Default("30s").Duration()
-	DbScrapeInterval          = kingpin.Flag("db-scrape-interval", "How often to scrape DB system views").Default("30s").Duration()
-	ElasticacheConnectTimeout = kingpin.Flag("ec-connect-timeout", "Elasticache connect timeout").Default("1s").Duration()
-	ElasticacheFilters        = kingpin.Flag("ec-filter", `a tag_name:tag_value pair for filtering EC instances by their tags while discovery (env: EC_FILTER)`).Envar("EC_FILTER").StringMap()
-	RdsFilters                = kingpin.Flag("rds-filter", `a tag_name:tag_value pair for filtering RDS instances by their tags while discovery (env: RDS_FILTER)`).Envar("RDS_FILTER").StringMap()
-	ListenAddress             = kingpin.Flag("listen-address", `Listen address (env: LISTEN_ADDRESS) - "<ip>:<port>" or ":<port>".`).Envar("LISTEN_ADDRESS").Default("0.0.0.0:80").String()
+	AwsRegion                  = kingpin.Flag("aws-region", "AWS region (env: AWS_REGION)").Envar("AWS_REGION").Required().String()
+	DiscoveryInterval          = kingpin.Flag("discovery-interval", "discovery interval").Default("60s").Duration()
+	RdsDbUser                  = kingpin.Flag("rds-db-user", "RDS db user (env: RDS_DB_USER)").Envar("RDS_DB_USER").String()
+	RdsDbPassword              = kingpin.Flag("rds-db-password", "RDS db password (env: RDS_DB_PASSWORD)").Envar("RDS_DB_PASSWORD").String()
+	RdsDbIamAuth               = kingpin.Flag("rds-db-iam-auth", "RDS IAM database authentication: auto (if enabled for the instance), always or never (env: RDS_DB_IAM_AUTH)").Envar("RDS_DB_IAM_AUTH").Default("auto").Enum("auto", "always", "never")
+	RdsDbSslMode               = kingpin.Flag("rds-db-sslmode", "RDS db SSL mode: disable, require, verify-ca or verify-full (env: RDS_DB_SSLMODE)").Envar("RDS_DB_SSLMODE").Default("require").Enum("disable", "require", "verify-ca", "verify-full")
+	RdsDbCaBundle              = kingpin.Flag("rds-db-ca-bundle", "Path to a CA bundle to verify RDS certificates, the embedded RDS bundle is used by default (env: RDS_DB_CA_BUNDLE)").Envar("RDS_DB_CA_BUNDLE").String()
+	RdsDbConnectTimeout        = kingpin.Flag("rds-db-connect-timeout", "RDS db connect timeout").Default("1s").Duration()
+	RdsDbQueryTimeout          = kingpin.Flag("rds-db-query-timeout", "RDS db query timeout").Default("30s").Duration()
+	RdsDbDiscoverDatabases     = kingpin.Flag("rds-db-discover-databases", "Scrape all databases of Postgres instances, not only the postgres database (env: RDS_DB_DISCOVER_DATABASES)").Envar("RDS_DB_DISCOVER_DATABASES").Bool()
+	RdsDbMaxDatabases          = kingpin.Flag("rds-db-max-databases", "Maximum number of databases to scrape per instance (0 for no limit)").Default("10").Int()
+	RdsDbIncludeDatabases      = kingpin.Flag("rds-db-include-database", "a glob pattern for databases to scrape, all databases are scraped if not specified").Strings()
+	RdsDbExcludeDatabases      = kingpin.Flag("rds-db-exclude-database", "a glob pattern for databases not to scrape").Default("rdsadmin").Strings()
+	RdsLogsScrapeInterval      = kingpin.Flag("rds-logs-scrape-interval", "RDS logs scrape interval (0 to disable)").Default("30s").Duration()
+	RdsLogsCheckpointStore     = kingpin.Flag("rds-logs-checkpoint-store", "Where to persist RDS log reader positions: file:///path/to/file.json, s3://bucket/prefix or dynamodb://table (env: RDS_LOGS_CHECKPOINT_STORE)").Envar("RDS_LOGS_CHECKPOINT_STORE").String()
+	RdsLogsMaxCatchUp          = kingpin.Flag("rds-logs-max-catch-up", "Maximum period of RDS logs written while the agent was down to catch up on, older positions resume from the start of the period").Default("1h").Duration()
+	RdsLogPatternsMax          = kingpin.Flag("rds-log-patterns-max", "Maximum number of log message patterns to export per instance, the rest are counted in the overflow bucket (0 for no limit)").Default("100").Int()
+	RdsPgLogLinePrefix         = kingpin.Flag("rds-pg-log-line-prefix", "log_line_prefix of RDS Postgres instances (env: RDS_PG_LOG_LINE_PREFIX)").Envar("RDS_PG_LOG_LINE_PREFIX").Default("%t:%r:%u@%d:[%p]:").String()
+	RdsSlowQueriesTop          = kingpin.Flag("rds-slow-queries-top", "Maximum number of query fingerprints extracted from Postgres logs to export per instance, the rest are exported as <other> (0 to disable)").Default("20").Int()
+	DbScrapeInterval           = kingpin.Flag("db-scrape-interval", "How often to scrape DB system views").Default("30s").Duration()
+	ElasticacheConnectTimeout  = kingpin.Flag("ec-connect-timeout", "Elasticache connect timeout").Default("1s").Duration()
+	ElasticacheFilters         = kingpin.Flag("ec-filter", `a tag_name:tag_value pair for filtering EC instances by their tags while discovery (env: EC_FILTER)`).Envar("EC_FILTER").StringMap()
+	ElasticacheRedisUser       = kingpin.Flag("ec-redis-user", "Redis ACL user to connect to Elasticache with (env: EC_REDIS_USER)").Envar("EC_REDIS_USER").String()
+	ElasticacheRedisPassword   = kingpin.Flag("ec-redis-password", "Redis AUTH token or password of the ACL user (env: EC_REDIS_PASSWORD)").Envar("EC_REDIS_PASSWORD").String()
+	ElasticacheRedisSecret     = kingpin.Flag("ec-redis-secret", "Name or ARN of the Secrets Manager secret with the Redis credentials: a JSON object with the username and password keys or a plain AUTH token. Can be overridden per cluster with the coroot-redis-secret and coroot-redis-user tags (env: EC_REDIS_SECRET)").Envar("EC_REDIS_SECRET").String()
+	ElasticacheMcDiscovery     = kingpin.Flag("ec-memcached-auto-discovery-interval", "How often to poll the configuration endpoints of Memcached clusters with `config get cluster` to pick up node changes between discovery intervals (0 to disable)").Default("0s").Duration()
+	ElasticacheBigKeys         = kingpin.Flag("ec-bigkeys", "Sample the keyspace of Elasticache Redis nodes with SCAN and MEMORY USAGE to find the largest key prefixes (env: EC_BIGKEYS)").Envar("EC_BIGKEYS").Bool()
+	ElasticacheBigKeysInterval = kingpin.Flag("ec-bigkeys-interval", "How often to run a round of keyspace sampling on each node").Default("30s").Duration()
+	ElasticacheBigKeysTime     = kingpin.Flag("ec-bigkeys-time-budget", "Maximum time spent on keyspace sampling per node and round").Default("200ms").Duration()
+	ElasticacheBigKeysCmds     = kingpin.Flag("ec-bigkeys-command-budget", "Maximum number of SCAN and MEMORY USAGE commands sent per node and round").Default("500").Int()
+	ElasticacheBigKeysTop      = kingpin.Flag("ec-bigkeys-top", "Number of the key prefixes with the largest memory usage and the most keys to export per node").Default("20").Int()
+	ElasticacheBigKeysDelim    = kingpin.Flag("ec-bigkeys-delimiter", "The key prefix is the part of the key before the first occurrence of the delimiter").Default(":").String()
+	ElasticacheBigKeysRegex    = kingpin.Flag("ec-bigkeys-prefix-regex", "A regular expression to extract the key prefix: the first capturing group or the whole match, takes precedence over the delimiter").Regexp()
+	ElasticacheBigKeysPrimary  = kingpin.Flag("ec-bigkeys-on-primaries", "Allow keyspace sampling on primary nodes, by default only replicas are sampled").Bool()
+	RdsFilters                 = kingpin.Flag("rds-filter", `a tag_name:tag_value pair for filtering RDS instances by their tags while discovery (env: RDS_FILTER)`).Envar("RDS_FILTER").StringMap()
+	LogSinkUrl                 = kingpin.Flag("log-sink-url", "URL of an OTLP/HTTP logs endpoint (e.g. http://otel-collector:4318/v1/logs) or Loki push API (e.g. http://loki:3100/loki/api/v1/push) to forward RDS log entries to (env: LOG_SINK_URL)").Envar("LOG_SINK_URL").String()
+	LogSinkFormat              = kingpin.Flag("log-sink-format", "Log sink format: otlp or loki (env: LOG_SINK_FORMAT)").Envar("LOG_SINK_FORMAT").Default("otlp").Enum("otlp", "loki")
+	LogSinkHeaders             = kingpin.Flag("log-sink-header", "a header_name:header_value pair to send to the log sink, e.g. for authentication (env: LOG_SINK_HEADER)").Envar("LOG_SINK_HEADER").StringMap()
+	LogSinkBufferSize          = kingpin.Flag("log-sink-buffer-size", "Maximum number of log entries buffered for the log sink").Default("10000").Int()
+	ListenAddress              = kingpin.Flag("listen-address", `Listen address (env: LISTEN_ADDRESS) - "<ip>:<port>" or ":<port>".`).Envar("LISTEN_ADDRESS").Default("0.0.0.0:80").String()
 )
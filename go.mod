@@ -3,12 +3,16 @@ module github.com/coroot/coroot-aws-agent
 go 1.19
 
 require (
-	github.com/aws/aws-sdk-go v1.44.273
+	github.com/aws/aws-sdk-go v1.55.5
 	github.com/coroot/coroot-pg-agent v1.2.2
 	github.com/coroot/logger v1.0.0
 	github.com/coroot/logparser v1.0.5
+	github.com/go-sql-driver/mysql v1.7.1
+	github.com/gomodule/redigo v1.8.9
+	github.com/lib/pq v1.10.3
 	github.com/oliver006/redis_exporter v1.50.0
 	github.com/prometheus/client_golang v1.15.1
+	github.com/prometheus/client_model v0.4.0
 	github.com/prometheus/memcached_exporter v0.13.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 )
@@ -24,13 +28,10 @@ require (
 	github.com/go-logfmt/logfmt v0.6.0 // indirect
 	github.com/go-logr/logr v1.0.0 // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
-	github.com/gomodule/redigo v1.8.9 // indirect
 	github.com/grobie/gomemcache v0.0.0-20230213081705-239240bbc445 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
-	github.com/lib/pq v1.10.3 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
 	github.com/mna/redisc v1.3.2 // indirect
-	github.com/prometheus/client_model v0.4.0 // indirect
 	github.com/prometheus/common v0.44.0 // indirect
 	github.com/prometheus/procfs v0.10.1 // indirect
 	github.com/sirupsen/logrus v1.9.0 // indirect
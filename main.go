@@ -7,12 +7,16 @@ import (
 	"github.com/coroot/coroot-aws-agent/elasticache"
 	"github.com/coroot/coroot-aws-agent/flags"
 	"github.com/coroot/coroot-aws-agent/rds"
+	"github.com/coroot/coroot-aws-agent/sink"
 	"github.com/coroot/logger"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -42,12 +46,35 @@ func main() {
 	reg := prometheus.NewRegistry()
 	reg.MustRegister(info("aws_agent_info", version))
 
-	go rds.NewDiscoverer(reg, awsSession).Run()
+	var logSink *sink.Sink
+	if *flags.LogSinkUrl != "" {
+		if logSink, err = sink.New(*flags.LogSinkUrl, *flags.LogSinkFormat, *flags.LogSinkHeaders, *flags.LogSinkBufferSize); err != nil {
+			log.Error(err)
+			return
+		}
+		reg.MustRegister(logSink)
+	}
+
+	go rds.NewDiscoverer(reg, awsSession, logSink).Run()
 	go elasticache.NewDiscoverer(reg, awsSession).Run()
 
 	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
 	log.Info("listening on:", *flags.ListenAddress)
-	log.Error(http.ListenAndServe(*flags.ListenAddress, nil))
+	errs := make(chan error, 1)
+	go func() {
+		errs <- http.ListenAndServe(*flags.ListenAddress, nil)
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err = <-errs:
+		log.Error(err)
+	case s := <-signals:
+		log.Info("received signal:", s)
+	}
+	if logSink != nil {
+		logSink.Stop()
+	}
 }
 
 func info(name, version string) prometheus.Collector {
@@ -0,0 +1,148 @@
+package rds
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds/rdsutils"
+	"github.com/coroot/coroot-aws-agent/flags"
+	"github.com/coroot/logger"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IAM auth tokens are valid for 15 minutes, so they are renewed well in advance
+const iamTokenRefreshInterval = 5 * time.Minute
+
+func (c *Collector) iamAuthEnabled() bool {
+	switch *flags.RdsDbIamAuth {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	return aws.BoolValue(c.instance.IAMDatabaseAuthenticationEnabled)
+}
+
+// iamTokenBuilder returns a function building a fresh IAM auth token for the current endpoint of the instance.
+// Tokens are signed locally, so it's cheap to build one for every new connection.
+func (c *Collector) iamTokenBuilder() func() (string, error) {
+	i := c.instance
+	endpoint := net.JoinHostPort(aws.StringValue(i.Endpoint.Address), strconv.Itoa(int(aws.Int64Value(i.Endpoint.Port))))
+	region, creds := c.region, c.sess.Config.Credentials
+	return func() (string, error) {
+		token, err := rdsutils.BuildAuthToken(endpoint, region, *flags.RdsDbUser, creds)
+		if err != nil {
+			return "", fmt.Errorf("failed to build IAM auth token: %w", err)
+		}
+		return token, nil
+	}
+}
+
+// iamRefresher keeps an IAM auth token of a Postgres instance in the pgpass file.
+// pg-agent connects via lib/pq, which reads the pgpass file on every new connection,
+// so reconnects always use a fresh token without restarting the collector.
+type iamRefresher struct {
+	keys []pgPassKey
+	stop chan bool
+}
+
+func startIamRefresher(keys []pgPassKey, token func() (string, error), logger logger.Logger) (*iamRefresher, error) {
+	t, err := token()
+	if err != nil {
+		return nil, err
+	}
+	if err = pgPass.set(keys, t); err != nil {
+		return nil, err
+	}
+	r := &iamRefresher{keys: keys, stop: make(chan bool)}
+	go func() {
+		ticker := time.NewTicker(iamTokenRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				t, err := token()
+				if err == nil {
+					err = pgPass.set(keys, t)
+				}
+				if err != nil {
+					logger.Warning("failed to refresh IAM auth token:", err)
+				}
+			}
+		}
+	}()
+	return r, nil
+}
+
+func (r *iamRefresher) Stop() {
+	close(r.stop)
+	pgPass.remove(r.keys)
+}
+
+type pgPassKey struct {
+	host string
+	port string
+	user string
+}
+
+// pgPassFile is the pgpass file shared by all Postgres collectors, lib/pq finds it via the PGPASSFILE variable
+type pgPassFile struct {
+	path    string
+	entries map[pgPassKey]string
+	lock    sync.Mutex
+}
+
+var pgPass = &pgPassFile{entries: map[pgPassKey]string{}}
+
+func (f *pgPassFile) set(keys []pgPassKey, password string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.path == "" {
+		f.path = filepath.Join(os.TempDir(), fmt.Sprintf("coroot-aws-agent-%d.pgpass", os.Getpid()))
+		if err := os.Setenv("PGPASSFILE", f.path); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		f.entries[key] = password
+	}
+	return f.write()
+}
+
+func (f *pgPassFile) remove(keys []pgPassKey) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, key := range keys {
+		delete(f.entries, key)
+	}
+	if f.path != "" {
+		_ = f.write()
+	}
+}
+
+// write replaces the file atomically, so lib/pq never reads a partially written one
+func (f *pgPassFile) write() error {
+	lines := make([]string, 0, len(f.entries))
+	for k, password := range f.entries {
+		lines = append(lines, strings.Join([]string{pgPassEscape(k.host), k.port, "*", pgPassEscape(k.user), pgPassEscape(password)}, ":"))
+	}
+	sort.Strings(lines)
+	tmp := f.path + ".tmp"
+	// lib/pq ignores the file if it's accessible by the group or others
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+func pgPassEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `:`, `\:`).Replace(s)
+}
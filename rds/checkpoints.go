@@ -0,0 +1,188 @@
+package rds
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogCheckpoint is the position of the log reader in a log file
+type LogCheckpoint struct {
+	Marker      string   `json:"marker"`
+	LastWritten int64    `json:"last_written"`
+	Size        int64    `json:"size"`
+	Seen        []string `json:"seen,omitempty"` // CloudWatch Logs only: the IDs of the events with the LastWritten timestamp
+}
+
+// LogCheckpoints are the positions of the log reader of an instance
+type LogCheckpoints struct {
+	SavedAt time.Time                 `json:"saved_at"`
+	Files   map[string]*LogCheckpoint `json:"files"`
+}
+
+type CheckpointStore interface {
+	Load(instanceKey string) (*LogCheckpoints, error)
+	Save(instanceKey string, checkpoints *LogCheckpoints) error
+}
+
+// NewCheckpointStore creates a store according to the URL:
+// file:///path/to/checkpoints.json, s3://bucket/prefix or dynamodb://table
+func NewCheckpointStore(sess *session.Session, storeUrl string) (CheckpointStore, error) {
+	u, err := url.Parse(storeUrl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file", "":
+		return &fileCheckpointStore{path: filepath.Join(u.Host, u.Path)}, nil
+	case "s3":
+		return &s3CheckpointStore{api: s3.New(sess), bucket: u.Host, prefix: strings.TrimPrefix(u.Path, "/")}, nil
+	case "dynamodb":
+		return &dynamodbCheckpointStore{api: dynamodb.New(sess), table: u.Host}, nil
+	}
+	return nil, fmt.Errorf("unsupported checkpoint store: %s", storeUrl)
+}
+
+type fileCheckpointStore struct {
+	path  string
+	state map[string]*LogCheckpoints
+	lock  sync.Mutex
+}
+
+func (s *fileCheckpointStore) load() error {
+	if s.state != nil {
+		return nil
+	}
+	s.state = map[string]*LogCheckpoints{}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, &s.state)
+}
+
+func (s *fileCheckpointStore) Load(instanceKey string) (*LogCheckpoints, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s.state[instanceKey], nil
+}
+
+func (s *fileCheckpointStore) Save(instanceKey string, checkpoints *LogCheckpoints) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.state[instanceKey] = checkpoints
+	data, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+type s3CheckpointStore struct {
+	api    *s3.S3
+	bucket string
+	prefix string
+}
+
+func (s *s3CheckpointStore) key(instanceKey string) string {
+	return path.Join(s.prefix, instanceKey+".json")
+}
+
+func (s *s3CheckpointStore) Load(instanceKey string) (*LogCheckpoints, error) {
+	out, err := s.api.GetObject(&s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(s.key(instanceKey))})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer out.Body.Close()
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, err
+	}
+	var res LogCheckpoints
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (s *s3CheckpointStore) Save(instanceKey string, checkpoints *LogCheckpoints) error {
+	data, err := json.Marshal(checkpoints)
+	if err != nil {
+		return err
+	}
+	_, err = s.api.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(instanceKey)),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+// dynamodbCheckpointStore stores checkpoints in a table with the instance_id string partition key
+type dynamodbCheckpointStore struct {
+	api   *dynamodb.DynamoDB
+	table string
+}
+
+func (s *dynamodbCheckpointStore) Load(instanceKey string) (*LogCheckpoints, error) {
+	out, err := s.api.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key:       map[string]*dynamodb.AttributeValue{"instance_id": {S: aws.String(instanceKey)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	v := out.Item["checkpoints"]
+	if v == nil || v.S == nil {
+		return nil, nil
+	}
+	var res LogCheckpoints
+	if err := json.Unmarshal([]byte(aws.StringValue(v.S)), &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (s *dynamodbCheckpointStore) Save(instanceKey string, checkpoints *LogCheckpoints) error {
+	data, err := json.Marshal(checkpoints)
+	if err != nil {
+		return err
+	}
+	_, err = s.api.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"instance_id": {S: aws.String(instanceKey)},
+			"checkpoints": {S: aws.String(string(data))},
+		},
+	})
+	return err
+}
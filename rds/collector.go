@@ -1,20 +1,25 @@
 package rds
 
 import (
+	"database/sql"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/rds"
 	"github.com/coroot/coroot-aws-agent/flags"
+	"github.com/coroot/coroot-aws-agent/rds/mysql"
+	"github.com/coroot/coroot-aws-agent/sink"
 	"github.com/coroot/coroot-aws-agent/utils"
 	postgres "github.com/coroot/coroot-pg-agent/collector"
 	"github.com/coroot/logger"
 	"github.com/coroot/logparser"
+	mysqlDriver "github.com/go-sql-driver/mysql"
 	"github.com/prometheus/client_golang/prometheus"
 	"net"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -47,6 +52,10 @@ var (
 	dNetRx     = utils.Desc("aws_rds_net_rx_bytes_per_second", "The number of bytes received per second", "interface")
 	dNetTx     = utils.Desc("aws_rds_net_tx_bytes_per_second", "The number of bytes transmitted per second", "interface")
 
+	dFailovers = utils.Desc("aws_rds_failovers_total", "Number of detected failovers: the endpoint started resolving to another IP or the instance moved to another availability zone")
+
+	dDbTLS = utils.Desc("aws_rds_db_tls_status", "Whether the connection to the DB is encrypted", "sslmode", "tls_version")
+
 	dLogMessages = utils.Desc("aws_rds_log_messages_total",
 		"Number of messages grouped by the automatically extracted repeated pattern",
 		"level", "pattern_hash", "sample")
@@ -73,22 +82,46 @@ type Collector struct {
 	instance rds.DBInstance
 	ip       *net.IPAddr
 
+	failovers int
+	status    *statusTracker
+	paused    bool
+
+	osHealth *utils.Health
+
 	cloudWatchLogsApi *cloudwatchlogs.CloudWatchLogs
 
-	dbCollector DbCollector
+	dbCollector  DbCollector
+	dbHealth     *utils.Health
+	pgDB         *sql.DB // the agent's own connection used to check the TLS status and to list databases
+	iamRefresher *iamRefresher
 
-	logReader *LogReader
-	logParser *logparser.Parser
+	logReader       *LogReader
+	logsHealth      *utils.Health
+	stopLogPatterns func()
+	logPatterns     *logPatterns
+	checkpointStore CheckpointStore
+	logSink         *sink.Sink
 
+	lock   sync.Mutex
+	reg    prometheus.Registerer
 	logger logger.Logger
 }
 
-func NewCollector(sess *session.Session, i *rds.DBInstance) (*Collector, error) {
+// NewCollector creates a collector of the instance, reg is the registerer the collector is registered with,
+// the per-database collectors are registered with it too
+func NewCollector(sess *session.Session, i *rds.DBInstance, checkpointStore CheckpointStore, logSink *sink.Sink, reg prometheus.Registerer) (*Collector, error) {
 	c := &Collector{
+		reg:               reg,
 		sess:              sess,
 		region:            aws.StringValue(sess.Config.Region),
 		instance:          *i,
 		cloudWatchLogsApi: cloudwatchlogs.New(sess),
+		checkpointStore:   checkpointStore,
+		logSink:           logSink,
+		logPatterns:       newLogPatterns(*flags.RdsLogPatternsMax),
+		dbHealth:          utils.NewHealth("db"),
+		logsHealth:        utils.NewHealth("logs"),
+		osHealth:          utils.NewHealth("os"),
 		logger:            logger.NewKlog(aws.StringValue(i.DBInstanceIdentifier)),
 	}
 	var err error
@@ -97,6 +130,13 @@ func NewCollector(sess *session.Session, i *rds.DBInstance) (*Collector, error)
 		return nil, err
 	}
 
+	c.status = newStatusTracker(aws.StringValue(i.DBInstanceStatus))
+	if !collectable(aws.StringValue(i.DBInstanceStatus)) {
+		c.logger.Info("the collectors are paused, the instance status is:", aws.StringValue(i.DBInstanceStatus))
+		c.paused = true
+		return c, nil
+	}
+
 	c.startDbCollector()
 	c.startLogCollector()
 
@@ -107,73 +147,276 @@ func (c *Collector) update(i *rds.DBInstance) {
 	if i == nil {
 		return
 	}
-	ci := c.instance
-	if aws.Int64Value(i.Endpoint.Port) != aws.Int64Value(ci.Endpoint.Port) || aws.StringValue(i.Endpoint.Address) != aws.StringValue(ci.Endpoint.Address) {
-		_ = c.dbCollector.Close()
-		c.instance = *i
-		c.startDbCollector()
-	}
+	// resolved before taking the lock, so a slow DNS response doesn't block scrapes
 	ip, err := net.ResolveIPAddr("", aws.StringValue(i.Endpoint.Address))
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ci := c.instance
+	endpointChanged := aws.Int64Value(i.Endpoint.Port) != aws.Int64Value(ci.Endpoint.Port) || aws.StringValue(i.Endpoint.Address) != aws.StringValue(ci.Endpoint.Address)
+	ipChanged := false
 	if err != nil {
 		c.logger.Error(err)
 	} else {
+		ipChanged = !ip.IP.Equal(c.ip.IP)
 		c.ip = ip
 	}
+	// the endpoint of a Multi-AZ instance stays the same after a failover, but it resolves to the new primary
+	azChanged := aws.StringValue(ci.AvailabilityZone) != "" && aws.StringValue(i.AvailabilityZone) != aws.StringValue(ci.AvailabilityZone)
+	if !endpointChanged && (ipChanged || azChanged) {
+		c.logger.Infof("failover detected: ip %s, availability zone %s -> %s", c.ip, aws.StringValue(ci.AvailabilityZone), aws.StringValue(i.AvailabilityZone))
+		c.failovers++
+	}
+
+	status := aws.StringValue(i.DBInstanceStatus)
+	if prev := c.status.update(status); prev != status {
+		c.logger.Infof("status changed: %s -> %s", prev, status)
+	}
+	switch {
+	case !collectable(status) && !c.paused:
+		c.logger.Info("pausing the collectors, the instance status is:", status)
+		c.paused = true
+		c.instance = *i
+		c.stopDbCollector()
+		c.stopLogCollector()
+		return
+	case !collectable(status):
+		c.instance = *i
+		return
+	case c.paused:
+		c.logger.Info("resuming the collectors, the instance status is:", status)
+		c.paused = false
+		c.instance = *i
+		c.startDbCollector()
+		c.startLogCollector()
+		return
+	}
+
+	switch {
+	case endpointChanged || ipChanged:
+		c.instance = *i
+		c.startDbCollector()
+	case !c.dbHealth.Up() && c.dbHealth.RetryDue():
+		c.logger.Info("retrying to init the db collector")
+		c.instance = *i
+		c.startDbCollector()
+	}
+	exportsChanged := strings.Join(aws.StringValueSlice(i.EnabledCloudwatchLogsExports), ",") != strings.Join(aws.StringValueSlice(ci.EnabledCloudwatchLogsExports), ",")
 	c.instance = *i
+	if exportsChanged {
+		c.logger.Info("the list of CloudWatch Logs exports has changed, restarting the log collector")
+		c.stopLogCollector()
+		c.startLogCollector()
+	}
 }
 
 func (c *Collector) startDbCollector() {
+	t := time.Now()
+	if err := c.initDbCollector(); err != nil {
+		c.logger.Warning(err)
+		c.dbHealth.Failure(err, time.Since(t))
+	}
+}
+
+func (c *Collector) stopDbCollector() {
 	if c.dbCollector != nil {
 		_ = c.dbCollector.Close()
+		c.dbCollector = nil
 	}
+	if c.pgDB != nil {
+		_ = c.pgDB.Close()
+		c.pgDB = nil
+	}
+	if c.iamRefresher != nil {
+		c.iamRefresher.Stop()
+		c.iamRefresher = nil
+	}
+}
+
+func (c *Collector) initDbCollector() error {
+	c.stopDbCollector()
 	i := c.instance
 	switch aws.StringValue(i.Engine) {
 	case "postgres", "aurora-postgresql":
-		endpoint := net.JoinHostPort(c.ip.String(), strconv.Itoa(int(aws.Int64Value(i.Endpoint.Port))))
+		port := strconv.Itoa(int(aws.Int64Value(i.Endpoint.Port)))
+		host := c.ip.String()
+		endpoint := net.JoinHostPort(host, port)
+		hostname := aws.StringValue(i.Endpoint.Address)
+		mode := c.sslMode()
 		userPass := url.UserPassword(*flags.RdsDbUser, *flags.RdsDbPassword)
+		if c.iamAuthEnabled() {
+			// the password is omitted, so lib/pq takes the current IAM auth token from the pgpass file
+			userPass = url.User(*flags.RdsDbUser)
+			keys := []pgPassKey{{host: host, port: port, user: *flags.RdsDbUser}}
+			if mode == "verify-full" {
+				keys = append(keys, pgPassKey{host: hostname, port: port, user: *flags.RdsDbUser})
+			}
+			refresher, err := startIamRefresher(keys, c.iamTokenBuilder(), c.logger)
+			if err != nil {
+				return err
+			}
+			c.iamRefresher = refresher
+		}
 		connectTimeout := int((*flags.RdsDbConnectTimeout).Seconds())
 		if connectTimeout < 1 {
 			connectTimeout = 1
 		}
 		statementTimeout := int((*flags.RdsDbQueryTimeout).Milliseconds())
-		dsn := fmt.Sprintf("postgresql://%s@%s/postgres?connect_timeout=%d&statement_timeout=%d", userPass, endpoint, connectTimeout, statementTimeout)
-		if collector, err := postgres.New(dsn, *flags.DbScrapeInterval, c.logger); err != nil {
-			c.logger.Warning("failed to init postgres collector:", err)
-		} else {
-			c.logger.Info("started postgres collector:", endpoint)
+		// pg-agent accepts only a DSN, so its connections can't verify the hostname while connecting to the resolved IP:
+		// with verify-full they fall back to verify-ca, and only the agent's own connection checks the hostname.
+		agentMode := mode
+		if mode == "verify-full" {
+			agentMode = "verify-ca"
+		}
+		tlsParams, err := pgTLSParams(agentMode)
+		if err != nil {
+			return fmt.Errorf("failed to configure TLS: %w", err)
+		}
+		dsn := func(database string) string {
+			return fmt.Sprintf("postgresql://%s@%s/%s?connect_timeout=%d&statement_timeout=%d%s",
+				userPass, endpoint, url.PathEscape(database), connectTimeout, statementTimeout, tlsParams)
+		}
+		if mode == "verify-full" {
+			fullParams, err := pgTLSParams(mode)
+			if err != nil {
+				return fmt.Errorf("failed to configure TLS: %w", err)
+			}
+			// lib/pq verifies the certificate against the DSN host, the connector dials the resolved IP instead
+			c.pgDB = sql.OpenDB(pgConnector{
+				dsn: fmt.Sprintf("postgresql://%s@%s/postgres?connect_timeout=%d&statement_timeout=%d%s",
+					userPass, net.JoinHostPort(hostname, port), connectTimeout, statementTimeout, fullParams),
+				addr: endpoint,
+			})
+		} else if c.pgDB, err = sql.Open("postgres", dsn("postgres")); err != nil {
+			return err
+		}
+		c.pgDB.SetMaxOpenConns(1)
+		c.pgDB.SetMaxIdleConns(1)
+		if *flags.RdsDbDiscoverDatabases {
+			collector, err := newMultiDbCollector(dsn, c.pgDB, c.reg, c.logger)
+			if err != nil {
+				return fmt.Errorf("failed to init postgres collectors: %w", err)
+			}
+			c.logger.Info("started postgres collectors:", endpoint)
 			c.dbCollector = collector
+			return nil
+		}
+		collector, err := postgres.New(dsn("postgres"), *flags.DbScrapeInterval, c.logger)
+		if err != nil {
+			return fmt.Errorf("failed to init postgres collector: %w", err)
+		}
+		c.logger.Info("started postgres collector:", endpoint)
+		c.dbCollector = collector
+	case "mysql", "mariadb", "aurora-mysql", "aurora":
+		endpoint := net.JoinHostPort(c.ip.String(), strconv.Itoa(int(aws.Int64Value(i.Endpoint.Port))))
+		cfg := mysqlDriver.NewConfig()
+		cfg.User = *flags.RdsDbUser
+		cfg.Passwd = *flags.RdsDbPassword
+		var password func() (string, error)
+		if c.iamAuthEnabled() {
+			password = c.iamTokenBuilder()
+		}
+		cfg.Net = "tcp"
+		cfg.Addr = endpoint
+		cfg.Timeout = *flags.RdsDbConnectTimeout
+		cfg.ReadTimeout = *flags.RdsDbQueryTimeout
+		cfg.WriteTimeout = *flags.RdsDbQueryTimeout
+		cfg.AllowCleartextPasswords = c.iamAuthEnabled() // IAM tokens are sent as cleartext passwords over TLS
+		var err error
+		if cfg.TLS, err = tlsConfig(c.sslMode(), aws.StringValue(i.Endpoint.Address)); err != nil {
+			return fmt.Errorf("failed to configure TLS: %w", err)
 		}
+		collector, err := mysql.New(cfg, password, *flags.DbScrapeInterval, *flags.RdsDbQueryTimeout, c.logger)
+		if err != nil {
+			return fmt.Errorf("failed to init mysql collector: %w", err)
+		}
+		c.logger.Info("started mysql collector:", endpoint)
+		c.dbCollector = collector
 	}
+	return nil
 }
 
 func (c *Collector) startLogCollector() {
 	if *flags.RdsLogsScrapeInterval <= 0 {
 		return
 	}
-	switch aws.StringValue(c.instance.Engine) {
-	case "postgres", "aurora-postgresql":
+	switch engine := aws.StringValue(c.instance.Engine); engine {
+	case "postgres", "aurora-postgresql", "mysql", "mariadb", "aurora-mysql", "aurora":
 		ch := make(chan logparser.LogEntry)
-		c.logParser = logparser.NewParser(ch, nil)
-		c.logReader = NewLogReader(rds.New(c.sess), c.instance.DBInstanceIdentifier, ch, *flags.RdsLogsScrapeInterval, c.logger)
+		c.stopLogPatterns = c.logPatterns.start(ch)
+		conf := LogReaderConf{
+			Engine:          engine,
+			RefreshInterval: *flags.RdsLogsScrapeInterval,
+			Health:          c.logsHealth,
+			CheckpointStore: c.checkpointStore,
+			CheckpointKey:   utils.IdWithRegion(c.region, aws.StringValue(c.instance.DBInstanceIdentifier)),
+			Sink:            c.logSink,
+			SinkAttributes: map[string]string{
+				"rds_instance_id": utils.IdWithRegion(c.region, aws.StringValue(c.instance.DBInstanceIdentifier)),
+				"region":          c.region,
+			},
+		}
+		if group, stream := c.cloudWatchLogGroup(); group != "" {
+			c.logger.Info("reading logs from CloudWatch Logs:", group)
+			conf.CloudWatchLogsApi = c.cloudWatchLogsApi
+			conf.CloudWatchLogGroup = group
+			conf.CloudWatchLogStream = stream
+		}
+		c.logReader = NewLogReader(rds.New(c.sess), c.instance.DBInstanceIdentifier, ch, conf, c.logger)
 	}
 }
 
-func (c *Collector) Close() {
-	if c.dbCollector != nil {
-		_ = c.dbCollector.Close()
+// cloudWatchLogGroup returns the CloudWatch Logs group (and the stream for Aurora clusters)
+// the instance exports its logs to, or an empty string if the export is disabled.
+func (c *Collector) cloudWatchLogGroup() (string, string) {
+	i := c.instance
+	var logType string
+	switch aws.StringValue(i.Engine) {
+	case "postgres", "aurora-postgresql":
+		logType = "postgresql"
+	default:
+		logType = "error"
+	}
+	enabled := false
+	for _, t := range i.EnabledCloudwatchLogsExports {
+		if aws.StringValue(t) == logType {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return "", ""
+	}
+	if i.DBClusterIdentifier != nil && strings.HasPrefix(aws.StringValue(i.Engine), "aurora") {
+		return fmt.Sprintf("/aws/rds/cluster/%s/%s", aws.StringValue(i.DBClusterIdentifier), logType), aws.StringValue(i.DBInstanceIdentifier)
 	}
+	return fmt.Sprintf("/aws/rds/instance/%s/%s", aws.StringValue(i.DBInstanceIdentifier), logType), ""
+}
+
+func (c *Collector) stopLogCollector() {
 	if c.logReader != nil {
 		c.logReader.Stop()
+		c.logReader = nil
 	}
-	if c.logParser != nil {
-		c.logParser.Stop()
+	if c.stopLogPatterns != nil {
+		c.stopLogPatterns()
+		c.stopLogPatterns = nil
 	}
 }
 
+func (c *Collector) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stopDbCollector()
+	c.stopLogCollector()
+}
+
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	i := c.instance
 
 	ch <- utils.Gauge(dStatus, 1, aws.StringValue(i.DBInstanceStatus))
+	c.status.collect(ch)
 
 	ch <- utils.Gauge(dInfo, 1,
 		c.region,
@@ -206,14 +449,20 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 	for _, r := range i.ReadReplicaDBInstanceIdentifiers {
 		ch <- utils.Gauge(dReadReplicaInfo, float64(1), utils.IdWithRegion(c.region, aws.StringValue(r)))
 	}
+	ch <- utils.Counter(dFailovers, float64(c.failovers))
 
 	wg := sync.WaitGroup{}
 
-	if aws.Int64Value(c.instance.MonitoringInterval) > 0 && c.instance.DbiResourceId != nil {
+	if aws.Int64Value(c.instance.MonitoringInterval) > 0 && c.instance.DbiResourceId != nil && !c.paused {
 		wg.Add(1)
 		go func() {
 			t := time.Now()
-			c.collectOsMetrics(ch)
+			if err := c.collectOsMetrics(ch); err != nil {
+				c.logger.Warning(err)
+				c.osHealth.Failure(err, time.Since(t))
+			} else {
+				c.osHealth.Success(time.Since(t))
+			}
 			c.logger.Info("os metrics collected in:", time.Since(t))
 			wg.Done()
 		}()
@@ -224,6 +473,11 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 		go func() {
 			t := time.Now()
 			c.dbCollector.Collect(ch)
+			if err := c.collectDbTLS(ch); err != nil {
+				c.dbHealth.Failure(err, time.Since(t))
+			} else {
+				c.dbHealth.Success(time.Since(t))
+			}
 			c.logger.Info("db metrics collected in:", time.Since(t))
 			wg.Done()
 		}()
@@ -231,16 +485,50 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 
 	wg.Wait()
 
-	if c.logParser != nil {
-		for _, lc := range c.logParser.GetCounters() {
-			ch <- utils.Counter(dLogMessages, float64(lc.Messages), lc.Level.String(), lc.Hash, lc.Sample)
+	c.dbHealth.Collect(ch)
+	c.logsHealth.Collect(ch)
+	c.osHealth.Collect(ch)
+
+	c.logPatterns.collect(ch)
+	if c.logReader != nil && c.logReader.slowQueries != nil {
+		c.logReader.slowQueries.collect(ch)
+	}
+}
+
+// collectDbTLS reports the TLS status of the agent's own connection to the DB,
+// the returned error tells whether the DB is reachable at all
+func (c *Collector) collectDbTLS(ch chan<- prometheus.Metric) error {
+	var version string
+	switch {
+	case c.pgDB != nil:
+		v, err := pgTLSVersion(c.pgDB)
+		if err != nil {
+			c.logger.Warning("failed to get the TLS status of the connection:", err)
+			return err
 		}
+		version = v
+	default:
+		mc, ok := c.dbCollector.(*mysql.Collector)
+		if !ok {
+			return nil
+		}
+		if err := mc.Err(); err != nil {
+			return err
+		}
+		version = mc.TLSVersion()
+	}
+	if version != "" {
+		ch <- utils.Gauge(dDbTLS, 1, c.sslMode(), version)
+	} else {
+		ch <- utils.Gauge(dDbTLS, 0, c.sslMode(), "")
 	}
+	return nil
 }
 
 func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- dInfo
 	ch <- dStatus
+	ch <- dStatusDuration
 	ch <- dAllocatedStorage
 	ch <- dCPUCores
 	ch <- dCpuUsage
@@ -256,5 +544,11 @@ func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- dFSUsed
 	ch <- dNetRx
 	ch <- dNetTx
+	ch <- dFailovers
+	ch <- dDbTLS
+	ch <- dDatabases
 	ch <- dLogMessages
+	ch <- dLogPatternsDropped
+	ch <- dSlowQueryDuration
+	utils.DescribeHealth(ch)
 }
@@ -0,0 +1,111 @@
+package rds
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"sort"
+	"time"
+)
+
+const maxCloudWatchPagesPerRefresh = 20
+
+// cloudWatchTail follows a CloudWatch Logs group the RDS logs are exported to
+type cloudWatchTail struct {
+	api     cloudwatchlogsiface.CloudWatchLogsAPI
+	group   string
+	streams []*string
+
+	nextToken  string
+	queryStart int64           // the start time the next token was issued for
+	startTime  int64           // the timestamp of the last seen event in ms
+	seen       map[string]bool // the IDs of the events with the startTime timestamp
+}
+
+func newCloudWatchTail(api cloudwatchlogsiface.CloudWatchLogsAPI, group, stream string) *cloudWatchTail {
+	t := &cloudWatchTail{api: api, group: group, seen: map[string]bool{}}
+	if stream != "" {
+		t.streams = []*string{aws.String(stream)}
+	}
+	return t
+}
+
+func (t *cloudWatchTail) checkpointName() string {
+	return "cloudwatch:" + t.group
+}
+
+func (t *cloudWatchTail) seenIds() []string {
+	ids := make([]string, 0, len(t.seen))
+	for id := range t.seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (r *LogReader) refreshCloudWatch(init bool) error {
+	cw := r.cloudWatch
+	if init {
+		if cp := r.resumeFrom; cp != nil && cp.Files[cw.checkpointName()] != nil {
+			r.logger.Infof("resuming reading %s from the checkpoint", cw.group)
+			cw.nextToken = cp.Files[cw.checkpointName()].Marker
+			cw.startTime = cp.Files[cw.checkpointName()].LastWritten
+			cw.seen = map[string]bool{}
+			for _, id := range cp.Files[cw.checkpointName()].Seen {
+				cw.seen[id] = true
+			}
+			if from := r.catchUpFrom.UnixMilli(); cw.startTime < from {
+				cw.nextToken = ""
+				cw.startTime = from
+				cw.seen = map[string]bool{}
+			}
+			cw.queryStart = cw.startTime
+		} else {
+			cw.startTime = time.Now().UnixMilli()
+		}
+	}
+
+	for i := 0; i < maxCloudWatchPagesPerRefresh; i++ {
+		if cw.nextToken == "" {
+			cw.queryStart = cw.startTime
+		}
+		input := &cloudwatchlogs.FilterLogEventsInput{
+			LogGroupName:   aws.String(cw.group),
+			LogStreamNames: cw.streams,
+			StartTime:      aws.Int64(cw.queryStart),
+		}
+		if cw.nextToken != "" {
+			input.NextToken = aws.String(cw.nextToken)
+		}
+		out, err := cw.api.FilterLogEvents(input)
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == cloudwatchlogs.ErrCodeInvalidParameterException && cw.nextToken != "" {
+				r.logger.Warning("the next token has expired, continuing from the last seen event:", err)
+				cw.nextToken = ""
+				continue
+			}
+			return fmt.Errorf("failed to read log group %s: %w", cw.group, err)
+		}
+		for _, e := range out.Events {
+			ts, id := aws.Int64Value(e.Timestamp), aws.StringValue(e.EventId)
+			if ts < cw.startTime || ts == cw.startTime && cw.seen[id] {
+				continue
+			}
+			if ts > cw.startTime {
+				cw.startTime = ts
+				cw.seen = map[string]bool{}
+			}
+			cw.seen[id] = true
+			r.write(aws.String(aws.StringValue(e.Message) + "\n"))
+		}
+		cw.nextToken = aws.StringValue(out.NextToken)
+		if cw.nextToken == "" {
+			break
+		}
+	}
+	r.resumeFrom = nil
+	r.saveCheckpoints()
+	return nil
+}
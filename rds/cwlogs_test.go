@@ -0,0 +1,80 @@
+package rds
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/coroot/logger"
+	"github.com/coroot/logparser"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeLogGroup struct {
+	cloudwatchlogsiface.CloudWatchLogsAPI
+	events []*cloudwatchlogs.FilteredLogEvent
+}
+
+func (g *fakeLogGroup) FilterLogEvents(input *cloudwatchlogs.FilterLogEventsInput) (*cloudwatchlogs.FilterLogEventsOutput, error) {
+	out := &cloudwatchlogs.FilterLogEventsOutput{}
+	for _, e := range g.events {
+		if aws.Int64Value(e.Timestamp) >= aws.Int64Value(input.StartTime) {
+			out.Events = append(out.Events, e)
+		}
+	}
+	return out, nil
+}
+
+type memCheckpointStore struct {
+	checkpoints *LogCheckpoints
+}
+
+func (s *memCheckpointStore) Load(string) (*LogCheckpoints, error) {
+	return s.checkpoints, nil
+}
+
+func (s *memCheckpointStore) Save(_ string, checkpoints *LogCheckpoints) error {
+	s.checkpoints = checkpoints
+	return nil
+}
+
+func TestCloudWatchResume(t *testing.T) {
+	ts := time.Now().UnixMilli()
+	event := func(id string) *cloudwatchlogs.FilteredLogEvent {
+		return &cloudwatchlogs.FilteredLogEvent{EventId: aws.String(id), Timestamp: aws.Int64(ts), Message: aws.String(id)}
+	}
+	group := &fakeLogGroup{events: []*cloudwatchlogs.FilteredLogEvent{event("a"), event("b")}}
+	store := &memCheckpointStore{}
+	newReader := func(ch chan logparser.LogEntry) *LogReader {
+		return &LogReader{
+			cloudWatch:      newCloudWatchTail(group, "group", ""),
+			ch:              ch,
+			checkpointStore: store,
+			catchUpFrom:     time.Now().Add(-time.Hour),
+			logger:          logger.NewKlog("test"),
+		}
+	}
+
+	ch := make(chan logparser.LogEntry, 100)
+	r := newReader(ch)
+	r.cloudWatch.startTime = ts
+	if err := r.refreshCloudWatch(false); err != nil {
+		t.Fatal(err)
+	}
+
+	group.events = append(group.events, event("c"))
+	r = newReader(ch)
+	r.resumeFrom = store.checkpoints
+	if err := r.refreshCloudWatch(true); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	var lines []string
+	for e := range ch {
+		lines = append(lines, e.Content)
+	}
+	if expected := []string{"a", "b", "c"}; !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected %v, got %v", expected, lines)
+	}
+}
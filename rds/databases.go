@@ -0,0 +1,266 @@
+package rds
+
+import (
+	"context"
+	"database/sql"
+	"github.com/coroot/coroot-aws-agent/flags"
+	"github.com/coroot/coroot-aws-agent/utils"
+	postgres "github.com/coroot/coroot-pg-agent/collector"
+	"github.com/coroot/logger"
+	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var (
+	dDatabases       = utils.Desc("aws_rds_db_databases", "Number of databases scraped by the agent")
+	dDatabaseScraped = utils.Desc("aws_rds_db_database_scraped", "Whether the database is scraped by the agent")
+)
+
+// instanceWideMetrics are the pg-agent metrics describing the whole instance rather than the database the collector is connected to
+var instanceWideMetrics = []string{
+	"pg_up", "pg_probe_seconds", "pg_info", "pg_setting", "pg_connections", "pg_latency_seconds",
+	"pg_lock_awaiting_queries", "pg_db_queries_per_second", "pg_top_query", "pg_wal_", "pg_replication", "pg_scrape",
+}
+
+var descRe = regexp.MustCompile(`fqName: "([^"]+)".*variableLabels: (.*)}$`)
+
+// multiDbCollector runs a separate Postgres collector for each database of the instance, labelled with db.
+// The instance-wide metrics are collected once by the collector connected to the postgres database,
+// the per-database collectors only export the metrics specific to their databases.
+type multiDbCollector struct {
+	dsn func(database string) string
+	db  *sql.DB
+	reg prometheus.Registerer
+
+	instance   *postgres.Collector
+	collectors map[string]*databaseCollector
+	closed     bool
+	lock       sync.Mutex
+	stop       chan bool
+
+	logger logger.Logger
+}
+
+func newMultiDbCollector(dsn func(database string) string, db *sql.DB, reg prometheus.Registerer, logger logger.Logger) (*multiDbCollector, error) {
+	instance, err := postgres.New(dsn("postgres"), *flags.DbScrapeInterval, logger)
+	if err != nil {
+		return nil, err
+	}
+	c := &multiDbCollector{
+		dsn:        dsn,
+		db:         db,
+		reg:        reg,
+		instance:   instance,
+		collectors: map[string]*databaseCollector{},
+		stop:       make(chan bool),
+		logger:     logger,
+	}
+	if err := c.refresh(); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	go c.run()
+	return c, nil
+}
+
+// run refreshes the list of databases in the background, since it queries the instance and starts new collectors
+func (c *multiDbCollector) run() {
+	ticker := time.NewTicker(*flags.DiscoveryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if err := c.refresh(); err != nil {
+				c.logger.Warning("failed to refresh the list of databases:", err)
+			}
+		}
+	}
+}
+
+func (c *multiDbCollector) refresh() error {
+	databases, err := c.listDatabases()
+	if err != nil {
+		return err
+	}
+	actual := map[string]bool{}
+	for _, db := range databases {
+		actual[db] = true
+	}
+
+	c.lock.Lock()
+	for db, collector := range c.collectors {
+		if !actual[db] {
+			c.logger.Info("database no longer exists:", db)
+			c.remove(db, collector)
+		}
+	}
+	var added []string
+	for _, db := range databases {
+		if c.collectors[db] == nil {
+			added = append(added, db)
+		}
+	}
+	c.lock.Unlock()
+
+	// the collectors are started without holding the lock, so a scrape doesn't wait for connections to new databases
+	for _, db := range added {
+		collector, err := postgres.New(c.dsn(db), *flags.DbScrapeInterval, c.logger)
+		if err != nil {
+			c.logger.Warningf("failed to init postgres collector for database %s: %s", db, err)
+			continue
+		}
+		if !c.add(db, &databaseCollector{Collector: collector}) {
+			_ = collector.Close()
+		}
+	}
+	return nil
+}
+
+func (c *multiDbCollector) add(db string, collector *databaseCollector) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return false
+	}
+	if err := c.wrappedReg(db).Register(collector); err != nil {
+		c.logger.Warningf("failed to register postgres collector for database %s: %s", db, err)
+		return false
+	}
+	c.logger.Info("started postgres collector for database:", db)
+	c.collectors[db] = collector
+	return true
+}
+
+func (c *multiDbCollector) remove(db string, collector *databaseCollector) {
+	c.wrappedReg(db).Unregister(collector)
+	_ = collector.Close()
+	delete(c.collectors, db)
+}
+
+func (c *multiDbCollector) wrappedReg(db string) prometheus.Registerer {
+	return prometheus.WrapRegistererWith(prometheus.Labels{"db": db}, c.reg)
+}
+
+func (c *multiDbCollector) listDatabases() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *flags.RdsDbQueryTimeout)
+	defer cancel()
+	rows, err := c.db.QueryContext(ctx, `SELECT datname FROM pg_database WHERE datallowconn AND NOT datistemplate`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if len(*flags.RdsDbIncludeDatabases) > 0 && !utils.Match(*flags.RdsDbIncludeDatabases, name) {
+			continue
+		}
+		if utils.Match(*flags.RdsDbExcludeDatabases, name) {
+			continue
+		}
+		res = append(res, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(res)
+	if limit := *flags.RdsDbMaxDatabases; limit > 0 && len(res) > limit {
+		c.logger.Warningf("%d databases found, only the first %d will be scraped", len(res), limit)
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+func (c *multiDbCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	count := len(c.collectors)
+	c.lock.Unlock()
+	ch <- utils.Gauge(dDatabases, float64(count))
+	c.instance.Collect(ch)
+}
+
+func (c *multiDbCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dDatabases
+	c.instance.Describe(ch)
+}
+
+func (c *multiDbCollector) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.stop)
+	for db, collector := range c.collectors {
+		c.remove(db, collector)
+	}
+	return c.instance.Close()
+}
+
+// databaseCollector describes a metric of its own, so the collector is a checked one and can be unregistered.
+// The instance-wide metrics are dropped, as well as the metrics having their own db label, which would collide with the wrapping one.
+type databaseCollector struct {
+	*postgres.Collector
+}
+
+func (c *databaseCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- utils.Gauge(dDatabaseScraped, 1)
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		c.Collector.Collect(metrics)
+		close(metrics)
+	}()
+	for m := range metrics {
+		if !instanceWide(m.Desc()) {
+			ch <- m
+		}
+	}
+}
+
+func (c *databaseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dDatabaseScraped
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		c.Collector.Describe(descs)
+		close(descs)
+	}()
+	for d := range descs {
+		if !instanceWide(d) {
+			ch <- d
+		}
+	}
+}
+
+func instanceWide(d *prometheus.Desc) bool {
+	m := descRe.FindStringSubmatch(d.String())
+	if m == nil {
+		return false
+	}
+	// the format of variable labels depends on the client version, e.g. [db] or [{db <nil>}]
+	labels := strings.FieldsFunc(m[2], func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	for _, l := range labels {
+		if l == "db" {
+			return true
+		}
+	}
+	for _, p := range instanceWideMetrics {
+		if strings.HasPrefix(m[1], p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package rds
+
+import (
+	"github.com/coroot/coroot-aws-agent/utils"
+	"testing"
+)
+
+func TestInstanceWide(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   []string
+		expected bool
+	}{
+		{name: "pg_up", expected: true},
+		{name: "pg_setting", labels: []string{"name", "unit"}, expected: true},
+		{name: "pg_connections", labels: []string{"db", "user", "state"}, expected: true},
+		{name: "pg_top_query_calls_per_second", labels: []string{"db", "user", "query"}, expected: true},
+		{name: "pg_wal_current_lsn", expected: true},
+		{name: "pg_custom_metric", labels: []string{"db"}, expected: true},
+		{name: "pg_table_size_bytes", labels: []string{"schema", "table"}, expected: false},
+		{name: "aws_rds_db_database_scraped", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := instanceWide(utils.Desc(tt.name, "help", tt.labels...)); got != tt.expected {
+				t.Errorf("instanceWide(%s) = %v, expected %v", tt.name, got, tt.expected)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/rds"
 	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
 	"github.com/coroot/coroot-aws-agent/flags"
+	"github.com/coroot/coroot-aws-agent/sink"
 	"github.com/coroot/coroot-aws-agent/utils"
 	"github.com/coroot/logger"
 	"github.com/prometheus/client_golang/prometheus"
@@ -17,18 +18,30 @@ type Discoverer struct {
 
 	awsSession *session.Session
 
+	checkpointStore CheckpointStore
+	logSink         *sink.Sink
+
 	instances map[string]*Collector
 
 	logger logger.Logger
 }
 
-func NewDiscoverer(reg prometheus.Registerer, awsSession *session.Session) *Discoverer {
+func NewDiscoverer(reg prometheus.Registerer, awsSession *session.Session, logSink *sink.Sink) *Discoverer {
 	d := &Discoverer{
 		reg:        reg,
 		awsSession: awsSession,
+		logSink:    logSink,
 		instances:  map[string]*Collector{},
 		logger:     logger.NewKlog(""),
 	}
+	if *flags.RdsLogsCheckpointStore != "" {
+		store, err := NewCheckpointStore(awsSession, *flags.RdsLogsCheckpointStore)
+		if err != nil {
+			d.logger.Warning("failed to init log checkpoint store:", err)
+		} else {
+			d.checkpointStore = store
+		}
+	}
 	return d
 }
 
@@ -82,13 +95,14 @@ func (d *Discoverer) refresh(api rdsiface.RDSAPI) error {
 		i, ok := d.instances[id]
 		if !ok {
 			d.logger.Info("new DB instance found:", id)
-			i, err = NewCollector(d.awsSession, dbInstance)
+			i, err = NewCollector(d.awsSession, dbInstance, d.checkpointStore, d.logSink, d.wrappedReg(id))
 			if err != nil {
 				d.logger.Warning("failed to init RDS collector:", err)
 				continue
 			}
 			if err := d.wrappedReg(id).Register(i); err != nil {
 				d.logger.Warning(err)
+				i.Close()
 				continue
 			}
 			d.instances[id] = i
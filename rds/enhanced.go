@@ -2,6 +2,7 @@ package rds
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/coroot/coroot-aws-agent/utils"
@@ -10,7 +11,7 @@ import (
 
 const rdsMetricsLogGroupName = "RDSOSMetrics"
 
-func (c *Collector) collectOsMetrics(ch chan<- prometheus.Metric) {
+func (c *Collector) collectOsMetrics(ch chan<- prometheus.Metric) error {
 	input := cloudwatchlogs.GetLogEventsInput{
 		Limit:         aws.Int64(1),
 		StartFromHead: aws.Bool(false),
@@ -19,16 +20,14 @@ func (c *Collector) collectOsMetrics(ch chan<- prometheus.Metric) {
 	}
 	out, err := c.cloudWatchLogsApi.GetLogEvents(&input)
 	if err != nil {
-		c.logger.Warningf("failed to read log stream %s:%s: %s", rdsMetricsLogGroupName, aws.StringValue(c.instance.DbiResourceId), err)
-		return
+		return fmt.Errorf("failed to read log stream %s:%s: %w", rdsMetricsLogGroupName, aws.StringValue(c.instance.DbiResourceId), err)
 	}
 	if len(out.Events) < 1 {
-		return
+		return nil
 	}
 	var m osMetrics
 	if err := json.Unmarshal([]byte(*out.Events[0].Message), &m); err != nil {
-		c.logger.Warning("failed to parse enhanced monitoring data:", err)
-		return
+		return fmt.Errorf("failed to parse enhanced monitoring data: %w", err)
 	}
 	ch <- utils.Gauge(dCPUCores, float64(m.NumVCPUs))
 	ch <- utils.Gauge(dCpuUsage, m.Cpu.Guest, "guest")
@@ -73,6 +72,7 @@ func (c *Collector) collectOsMetrics(ch chan<- prometheus.Metric) {
 		ch <- utils.Gauge(dNetRx, iface.Rx, iface.Interface)
 		ch <- utils.Gauge(dNetTx, iface.Tx, iface.Interface)
 	}
+	return nil
 }
 
 type osMetrics struct {
@@ -0,0 +1,155 @@
+package rds
+
+import (
+	"context"
+	"github.com/coroot/coroot-aws-agent/utils"
+	"github.com/coroot/logparser"
+	"github.com/prometheus/client_golang/prometheus"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	logPatternOverflow = "overflow"
+	multilineTimeout   = 100 * time.Millisecond
+)
+
+var (
+	dLogPatternsDropped = utils.Desc("aws_rds_log_patterns_dropped_total",
+		"Number of distinct log patterns counted in the overflow bucket because the limit of patterns was reached")
+
+	redactions = []struct {
+		re          *regexp.Regexp
+		replacement string
+	}{
+		{regexp.MustCompile(`"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.|'')*'`), "?"},
+		{regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`), "<uuid>"},
+		{regexp.MustCompile(`[\w.+-]+@[\w-]+(?:\.[\w-]+)+`), "<email>"},
+		{regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}(?::\d+)?\b`), "<ip>"},
+		{regexp.MustCompile(`(?i)\b(?:[0-9a-f]{1,4}:){3,7}[0-9a-f]{1,4}\b|\b(?:[0-9a-f]{1,4}:)+:(?:[0-9a-f]{1,4}:)*[0-9a-f]{1,4}\b`), "<ip>"},
+		{regexp.MustCompile(`(?i)\b[0-9a-f]{16,}\b`), "?"},
+		{regexp.MustCompile(`\b\d+(?:\.\d+)?\b`), "?"},
+	}
+)
+
+// redact replaces the literals that may contain sensitive data with placeholders
+func redact(sample string) string {
+	for _, r := range redactions {
+		sample = r.re.ReplaceAllString(sample, r.replacement)
+	}
+	return sample
+}
+
+type logPatternKey struct {
+	level logparser.Level
+	hash  string
+}
+
+type logPatternStat struct {
+	pattern  *logparser.Pattern
+	sample   string
+	messages float64
+}
+
+// logPatterns groups log messages by the automatically extracted repeated pattern the same way logparser.Parser does,
+// but the number of patterns is limited at ingestion: once the limit is reached, the messages of new patterns
+// are counted in the overflow bucket of their level, so the memory usage doesn't grow with the variety of messages.
+// Only the hashes of the dropped patterns are kept to count each of them once.
+type logPatterns struct {
+	limit    int
+	patterns map[logPatternKey]*logPatternStat
+	counted  int // the number of patterns subject to the limit, the level-only keys are not
+	overflow map[logparser.Level]float64
+	dropped  map[logPatternKey]bool
+	lock     sync.Mutex
+}
+
+func newLogPatterns(limit int) *logPatterns {
+	return &logPatterns{
+		limit:    limit,
+		patterns: map[logPatternKey]*logPatternStat{},
+		overflow: map[logparser.Level]float64{},
+		dropped:  map[logPatternKey]bool{},
+	}
+}
+
+// start reads log entries from the channel, merges multi-line messages and counts them until the returned function is called
+func (p *logPatterns) start(ch <-chan logparser.LogEntry) func() {
+	ctx, stop := context.WithCancel(context.Background())
+	mc := logparser.NewMultilineCollector(ctx, multilineTimeout)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-ch:
+				mc.Add(e)
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-mc.Messages:
+				if !ok {
+					return
+				}
+				p.observe(msg)
+			}
+		}
+	}()
+	return stop
+}
+
+func (p *logPatterns) observe(msg logparser.Message) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	// like logparser.Parser, messages of these levels are counted without patterns
+	if msg.Level == logparser.LevelUnknown || msg.Level == logparser.LevelDebug || msg.Level == logparser.LevelInfo {
+		key := logPatternKey{level: msg.Level}
+		if p.patterns[key] == nil {
+			p.patterns[key] = &logPatternStat{}
+		}
+		p.patterns[key].messages++
+		return
+	}
+	pattern := logparser.NewPattern(msg.Content)
+	key := logPatternKey{level: msg.Level, hash: pattern.Hash()}
+	stat := p.patterns[key]
+	if stat == nil {
+		for k, ps := range p.patterns {
+			if k.level == msg.Level && ps.pattern != nil && ps.pattern.WeakEqual(pattern) {
+				stat = ps
+				break
+			}
+		}
+	}
+	if stat == nil {
+		if p.limit > 0 && p.counted >= p.limit {
+			p.overflow[msg.Level]++
+			p.dropped[key] = true
+			return
+		}
+		stat = &logPatternStat{pattern: pattern, sample: msg.Content}
+		p.patterns[key] = stat
+		p.counted++
+	}
+	stat.messages++
+}
+
+func (p *logPatterns) collect(ch chan<- prometheus.Metric) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for k, ps := range p.patterns {
+		ch <- utils.Counter(dLogMessages, ps.messages, k.level.String(), k.hash, redact(ps.sample))
+	}
+	for level, messages := range p.overflow {
+		ch <- utils.Counter(dLogMessages, messages, level.String(), logPatternOverflow, "")
+	}
+	if p.limit > 0 {
+		ch <- utils.Counter(dLogPatternsDropped, float64(len(p.dropped)))
+	}
+}
@@ -0,0 +1,75 @@
+package rds
+
+import (
+	"github.com/coroot/logparser"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		sample   string
+		expected string
+	}{
+		{
+			sample:   `duplicate key value violates unique constraint "users_email_key"`,
+			expected: `duplicate key value violates unique constraint ?`,
+		},
+		{
+			sample:   `invalid input syntax for type integer: 'abc'`,
+			expected: `invalid input syntax for type integer: ?`,
+		},
+		{
+			sample:   "connection received: host=10.0.0.5 port=41002",
+			expected: "connection received: host=<ip> port=?",
+		},
+		{
+			sample:   "connection from fe80::1 rejected",
+			expected: "connection from <ip> rejected",
+		},
+		{
+			sample:   "user 550e8400-e29b-41d4-a716-446655440000 not found",
+			expected: "user <uuid> not found",
+		},
+		{
+			sample:   "notification sent to john.doe@example.com",
+			expected: "notification sent to <email>",
+		},
+		{
+			sample:   "checkpoint complete: wrote 12 buffers (0.1%); 1.5 s",
+			expected: "checkpoint complete: wrote ? buffers (?%); ? s",
+		},
+		{
+			sample:   "invalid token deadbeefdeadbeefdeadbeef",
+			expected: "invalid token ?",
+		},
+	}
+	for _, tt := range tests {
+		if got := redact(tt.sample); got != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.sample, tt.expected, got)
+		}
+	}
+}
+
+func TestLogPatternsLimit(t *testing.T) {
+	p := newLogPatterns(2)
+	for _, m := range []logparser.Message{
+		{Level: logparser.LevelInfo, Content: "checkpoint starting: time"},
+		{Level: logparser.LevelUnknown, Content: "some line"},
+		{Level: logparser.LevelError, Content: "relation users does not exist"},
+		{Level: logparser.LevelError, Content: "could not serialize access due to concurrent update"},
+		{Level: logparser.LevelError, Content: "canceling statement due to statement timeout"},
+		{Level: logparser.LevelError, Content: "canceling statement due to statement timeout"},
+		{Level: logparser.LevelWarning, Content: "there is no transaction in progress"},
+	} {
+		p.observe(m)
+	}
+	if p.counted != 2 {
+		t.Errorf("the level-only keys must not count towards the limit, got %d patterns", p.counted)
+	}
+	if got := p.overflow[logparser.LevelError]; got != 2 {
+		t.Errorf("expected 2 error messages in the overflow bucket, got %v", got)
+	}
+	if len(p.dropped) != 2 {
+		t.Errorf("expected 2 distinct dropped patterns, got %d", len(p.dropped))
+	}
+}
@@ -4,43 +4,137 @@ import (
 	"bufio"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
 	"github.com/aws/aws-sdk-go/service/rds"
 	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"github.com/coroot/coroot-aws-agent/flags"
+	"github.com/coroot/coroot-aws-agent/sink"
+	"github.com/coroot/coroot-aws-agent/utils"
 	"github.com/coroot/logger"
 	"github.com/coroot/logparser"
+	"reflect"
+	"sort"
 	"strings"
 	"time"
 )
 
-// supports only Postgresql RDS log for now
-// need more work to support for example Mysql RDS logs, because of rotation
+const (
+	maxPortionsPerRefresh  = 10
+	checkpointSaveInterval = 5 * time.Minute
+	pgPendingTimeout       = 10 * time.Second
+
+	// mysql-error.log duplicates the lines of mysql-error-running.log, so only the latter and its rotated files are read
+	mysqlErrorLogPrefix = "error/mysql-error-running.log"
+)
+
+// LogReader reads RDS log files using the DownloadDBLogFilePortion API.
+// MySQL and MariaDB rotate their error logs: error/mysql-error-running.log is renamed to error/mysql-error-running.log.N,
+// so for these engines the reader continues reading a rotated file from the marker of the original one.
+// The rotated files are reused (N is the hour), so a known rotated file getting smaller or older is treated as a new one.
 type LogReader struct {
-	api        rdsiface.RDSAPI
-	instanceId *string
-	logs       map[string]*logFileMeta
-	ch         chan<- logparser.LogEntry
-	stop       chan bool
-	logger     logger.Logger
+	api         rdsiface.RDSAPI
+	instanceId  *string
+	filePrefix  string
+	rotating    bool
+	pgParser    *pgLogParser
+	slowQueries *slowQueries
+	logs        map[string]*logFileMeta
+	cloudWatch  *cloudWatchTail
+	ch          chan<- logparser.LogEntry
+
+	sink           *sink.Sink
+	sinkAttributes map[string]string
+
+	checkpointStore CheckpointStore
+	checkpointKey   string
+	resumeFrom      *LogCheckpoints
+	catchUpFrom     time.Time
+	savedFiles      map[string]LogCheckpoint
+	savedAt         time.Time
+
+	stop   chan bool
+	logger logger.Logger
 }
 
-func NewLogReader(api rdsiface.RDSAPI, instanceId *string, ch chan<- logparser.LogEntry, refreshInterval time.Duration, logger logger.Logger) *LogReader {
+type LogReaderConf struct {
+	Engine          string
+	RefreshInterval time.Duration
+	Health          *utils.Health
+
+	// if set, the logs are read from the CloudWatch Logs group instead of the log files
+	CloudWatchLogsApi   cloudwatchlogsiface.CloudWatchLogsAPI
+	CloudWatchLogGroup  string
+	CloudWatchLogStream string
+
+	CheckpointStore CheckpointStore
+	CheckpointKey   string
+
+	Sink           *sink.Sink
+	SinkAttributes map[string]string
+}
+
+func NewLogReader(api rdsiface.RDSAPI, instanceId *string, ch chan<- logparser.LogEntry, conf LogReaderConf, logger logger.Logger) *LogReader {
 	r := &LogReader{
-		api:        api,
-		instanceId: instanceId,
-		logs:       map[string]*logFileMeta{},
-		ch:         ch,
-		stop:       make(chan bool),
-		logger:     logger,
-	}
-	initialized := r.refresh(true)
+		api:             api,
+		instanceId:      instanceId,
+		logs:            map[string]*logFileMeta{},
+		ch:              ch,
+		stop:            make(chan bool),
+		sink:            conf.Sink,
+		sinkAttributes:  conf.SinkAttributes,
+		checkpointStore: conf.CheckpointStore,
+		checkpointKey:   conf.CheckpointKey,
+		logger:          logger,
+	}
+	if conf.Health == nil {
+		conf.Health = utils.NewHealth("logs")
+	}
+	if conf.CloudWatchLogsApi != nil {
+		r.cloudWatch = newCloudWatchTail(conf.CloudWatchLogsApi, conf.CloudWatchLogGroup, conf.CloudWatchLogStream)
+	}
+	switch conf.Engine {
+	case "mysql", "mariadb", "aurora-mysql", "aurora":
+		r.filePrefix = mysqlErrorLogPrefix
+		r.rotating = true
+	case "postgres", "aurora-postgresql":
+		if p, err := newPgLogParser(*flags.RdsPgLogLinePrefix); err != nil {
+			r.logger.Warning("failed to parse log_line_prefix, log lines will be processed as is:", err)
+		} else {
+			r.pgParser = p
+		}
+		if *flags.RdsSlowQueriesTop > 0 {
+			r.slowQueries = newSlowQueries(*flags.RdsSlowQueriesTop)
+		}
+	}
+	refresh := r.refresh
+	if r.cloudWatch != nil {
+		refresh = r.refreshCloudWatch
+	}
+	run := func(init bool) bool {
+		t := time.Now()
+		err := refresh(init)
+		r.flushPending()
+		r.logger.Info("logs refreshed in:", time.Since(t))
+		if err != nil {
+			r.logger.Warning(err)
+			conf.Health.Failure(err, time.Since(t))
+			return false
+		}
+		conf.Health.Success(time.Since(t))
+		return true
+	}
+	// loading the checkpoints from S3 or DynamoDB and catching up may take a while, so it's done in the background
 	go func() {
-		t := time.NewTicker(refreshInterval)
+		r.loadCheckpoints()
+		initialized := run(true)
+		t := time.NewTicker(conf.RefreshInterval)
+		defer t.Stop()
 		for {
 			select {
 			case <-r.stop:
 				return
 			case <-t.C:
-				if ok := r.refresh(!initialized); ok {
+				if ok := run(!initialized); ok {
 					initialized = true
 				}
 			}
@@ -53,28 +147,38 @@ func (r *LogReader) Stop() {
 	r.stop <- true
 }
 
-func (r *LogReader) refresh(init bool) bool {
-	t := time.Now()
-	defer func() {
-		r.logger.Info("logs refreshed in:", time.Since(t))
-	}()
+func (r *LogReader) refresh(init bool) error {
 	res, err := r.api.DescribeDBLogFiles(&rds.DescribeDBLogFilesInput{DBInstanceIdentifier: r.instanceId})
 	if err != nil {
-		r.logger.Warning("failed to describe log files:", err)
-		return false
+		return fmt.Errorf("failed to describe log files: %w", err)
 	}
-	seenLogs := map[string]bool{}
+	var files []*rds.DescribeDBLogFilesDetails
 	for _, f := range res.DescribeDBLogFiles {
+		if strings.HasPrefix(aws.StringValue(f.LogFileName), r.filePrefix) {
+			files = append(files, f)
+		}
+	}
+	// rotated files must be processed before the files they were rotated from
+	sort.SliceStable(files, func(i, j int) bool {
+		return r.rotatedFrom(aws.StringValue(files[i].LogFileName)) != "" && r.rotatedFrom(aws.StringValue(files[j].LogFileName)) == ""
+	})
+
+	seenLogs := map[string]bool{}
+	for _, f := range files {
 		fileName := aws.StringValue(f.LogFileName)
 		seenLogs[fileName] = true
 		meta := r.logs[fileName]
-		if meta == nil {
+		isNew := meta == nil // a rotated file is matched with the base one only when it appears
+		if isNew {
 			r.logger.Info("new log file detected:", fileName)
 			meta = &logFileMeta{}
 			r.logs[fileName] = meta
 		}
 
-		if init {
+		if init && r.resume(fileName, f, meta) {
+			r.logger.Infof("resuming reading %s from the checkpoint", fileName)
+			isNew = r.resumeFrom.Files[fileName] == nil
+		} else if init {
 			var n int64 = 1 // read last line to obtain the marker
 			response, err := r.download(fileName, nil, &n)
 			if err != nil {
@@ -82,21 +186,51 @@ func (r *LogReader) refresh(init bool) bool {
 				continue
 			}
 			meta.lastWritten = aws.Int64Value(f.LastWritten)
+			meta.size = aws.Int64Value(f.Size)
 			meta.marker = aws.StringValue(response.Marker)
 			continue
 		}
 
-		if meta.lastWritten >= aws.Int64Value(f.LastWritten) {
+		rotated := isNew
+		if !isNew && r.rotatedFrom(fileName) != "" && (aws.Int64Value(f.Size) < meta.size || aws.Int64Value(f.LastWritten) < meta.lastWritten) {
+			r.logger.Infof("log file %s has been replaced by a newer rotation", fileName)
+			rotated = true
+			meta.marker = "0"
+		}
+
+		if !rotated && meta.lastWritten >= aws.Int64Value(f.LastWritten) {
 			continue
 		}
-		response, err := r.download(fileName, &meta.marker, nil)
+
+		if base := r.logs[r.rotatedFrom(fileName)]; rotated && base != nil {
+			// the file has just been renamed from the base one, so it contains the data following the base file's marker
+			r.logger.Infof("log file %s rotated to %s", r.rotatedFrom(fileName), fileName)
+			if base.rotatedMarker != "" {
+				// the truncation has been handled already, the base file is being read from the start
+				meta.marker = base.rotatedMarker
+				base.rotatedMarker = ""
+			} else {
+				meta.marker = base.marker
+				base.marker = "0"
+				base.size = 0
+			}
+		} else if r.rotating && aws.Int64Value(f.Size) < meta.size {
+			// the file has been truncated, the rotated file may appear later
+			r.logger.Infof("log file %s has been truncated", fileName)
+			meta.rotatedMarker = meta.marker
+			meta.marker = "0"
+		}
+
+		drained, err := r.read(fileName, meta)
 		if err != nil {
 			r.logger.Warning(err)
 			continue
 		}
-		meta.lastWritten = aws.Int64Value(f.LastWritten)
-		meta.marker = aws.StringValue(response.Marker)
-		r.write(response.LogFileData)
+		// otherwise, the file is read further during the next refresh even if it's not written anymore
+		if drained {
+			meta.lastWritten = aws.Int64Value(f.LastWritten)
+			meta.size = aws.Int64Value(f.Size)
+		}
 	}
 
 	for name := range r.logs {
@@ -104,7 +238,112 @@ func (r *LogReader) refresh(init bool) bool {
 			delete(r.logs, name)
 		}
 	}
-	return true
+	r.resumeFrom = nil
+	r.saveCheckpoints()
+	return nil
+}
+
+func (r *LogReader) loadCheckpoints() {
+	if r.checkpointStore == nil {
+		return
+	}
+	checkpoints, err := r.checkpointStore.Load(r.checkpointKey)
+	if err != nil {
+		r.logger.Warning("failed to load log checkpoints:", err)
+		return
+	}
+	if checkpoints == nil {
+		return
+	}
+	r.catchUpFrom = time.Now().Add(-*flags.RdsLogsMaxCatchUp)
+	if since := time.Since(checkpoints.SavedAt); since > *flags.RdsLogsMaxCatchUp {
+		r.logger.Infof("log checkpoints were saved %s ago, which exceeds the maximum catch-up window: log files are read from their end, CloudWatch Logs from the window start", since.Truncate(time.Second))
+	}
+	r.resumeFrom = checkpoints
+}
+
+// resume restores the file position from the checkpoint.
+// The unread part of a file was written after the checkpoints had been saved, and a marker can't be derived from a timestamp,
+// so if the checkpoints are older than the catch-up window, the file is read from its end instead.
+func (r *LogReader) resume(fileName string, f *rds.DescribeDBLogFilesDetails, meta *logFileMeta) bool {
+	if r.resumeFrom == nil || r.resumeFrom.SavedAt.Before(r.catchUpFrom) {
+		return false
+	}
+	// the unread part of the file, if any, is older than the catch-up window
+	if aws.Int64Value(f.LastWritten) < r.catchUpFrom.UnixMilli() {
+		return false
+	}
+	if cp := r.resumeFrom.Files[fileName]; cp != nil {
+		meta.marker = cp.Marker
+		meta.lastWritten = cp.LastWritten
+		meta.size = cp.Size
+		return true
+	}
+	// the file was created while the agent was down
+	if aws.Int64Value(f.LastWritten) > r.resumeFrom.SavedAt.UnixMilli() {
+		meta.marker = "0"
+		return true
+	}
+	return false
+}
+
+func (r *LogReader) saveCheckpoints() {
+	if r.checkpointStore == nil {
+		return
+	}
+	files := map[string]LogCheckpoint{}
+	for name, meta := range r.logs {
+		files[name] = LogCheckpoint{Marker: meta.marker, LastWritten: meta.lastWritten, Size: meta.size}
+	}
+	if cw := r.cloudWatch; cw != nil {
+		files[cw.checkpointName()] = LogCheckpoint{Marker: cw.nextToken, LastWritten: cw.startTime, Seen: cw.seenIds()}
+	}
+	// unchanged checkpoints are saved periodically anyway to keep SavedAt within the catch-up window
+	if reflect.DeepEqual(files, r.savedFiles) && time.Since(r.savedAt) < checkpointSaveInterval {
+		return
+	}
+	checkpoints := &LogCheckpoints{SavedAt: time.Now(), Files: map[string]*LogCheckpoint{}}
+	for name, cp := range files {
+		cp := cp
+		checkpoints.Files[name] = &cp
+	}
+	if err := r.checkpointStore.Save(r.checkpointKey, checkpoints); err != nil {
+		r.logger.Warning("failed to save log checkpoints:", err)
+		return
+	}
+	r.savedFiles = files
+	r.savedAt = checkpoints.SavedAt
+}
+
+// rotatedFrom returns the name of the tracked file the given one was rotated from, e.g.:
+// error/mysql-error-running.log.3 -> error/mysql-error-running.log
+func (r *LogReader) rotatedFrom(fileName string) string {
+	if !r.rotating {
+		return ""
+	}
+	for name := range r.logs {
+		if strings.HasPrefix(fileName, name+".") {
+			return name
+		}
+	}
+	return ""
+}
+
+// read downloads up to maxPortionsPerRefresh portions of the file starting from the marker
+// and reports whether the end of the file has been reached
+func (r *LogReader) read(fileName string, meta *logFileMeta) (bool, error) {
+	for i := 0; i < maxPortionsPerRefresh; i++ {
+		response, err := r.download(fileName, &meta.marker, nil)
+		if err != nil {
+			return false, err
+		}
+		meta.marker = aws.StringValue(response.Marker)
+		r.write(response.LogFileData)
+		if !aws.BoolValue(response.AdditionalDataPending) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func (r *LogReader) download(logFileName string, marker *string, numberOfLines *int64) (*rds.DownloadDBLogFilePortionOutput, error) {
@@ -128,11 +367,44 @@ func (r *LogReader) write(data *string) {
 		if err != nil {
 			break
 		}
-		r.ch <- logparser.LogEntry{Content: strings.TrimSuffix(line, "\n"), Level: logparser.LevelUnknown}
+		line = strings.TrimSuffix(line, "\n")
+		if r.pgParser == nil {
+			r.send(&logRecord{Message: line})
+			continue
+		}
+		if rec := r.pgParser.feed(line); rec != nil {
+			r.send(rec)
+		}
+	}
+}
+
+// flushPending sends the multi-line record being assembled once no more lines have followed it for a while
+func (r *LogReader) flushPending() {
+	if r.pgParser == nil {
+		return
+	}
+	if rec := r.pgParser.flushStale(pgPendingTimeout); rec != nil {
+		r.send(rec)
+	}
+}
+
+func (r *LogReader) send(rec *logRecord) {
+	if r.slowQueries != nil {
+		r.slowQueries.observe(rec)
+	}
+	if r.sink != nil {
+		e := sink.Entry{Timestamp: rec.Timestamp, Level: rec.Level, Body: rec.content(), Attributes: r.sinkAttributes}
+		if rec.Database != "" || rec.User != "" {
+			e.Metadata = map[string]string{"db": rec.Database, "user": rec.User}
+		}
+		r.sink.Send(e)
 	}
+	r.ch <- logparser.LogEntry{Content: rec.content(), Level: rec.Level}
 }
 
 type logFileMeta struct {
-	lastWritten int64
-	marker      string
+	lastWritten   int64
+	size          int64
+	marker        string
+	rotatedMarker string
 }
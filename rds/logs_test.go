@@ -0,0 +1,227 @@
+package rds
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"github.com/coroot/logger"
+	"github.com/coroot/logparser"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const mysqlErrorLog = mysqlErrorLogPrefix
+
+// fakeLogFiles serves the log files, the marker is the offset in the file
+type fakeLogFiles struct {
+	rdsiface.RDSAPI
+	files       map[string]string
+	lastWritten int64
+}
+
+// write appends the data to the file and bumps its LastWritten
+func (f *fakeLogFiles) write(name, data string) {
+	f.lastWritten++
+	f.files[name] += data
+}
+
+// rotate renames the file to name.n and starts a new one
+func (f *fakeLogFiles) rotate(name string, n int, data string) {
+	f.files[name+"."+strconv.Itoa(n)] = f.files[name]
+	f.files[name] = ""
+	f.write(name, data)
+}
+
+func (f *fakeLogFiles) DescribeDBLogFiles(*rds.DescribeDBLogFilesInput) (*rds.DescribeDBLogFilesOutput, error) {
+	var names []string
+	for name := range f.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := &rds.DescribeDBLogFilesOutput{}
+	for _, name := range names {
+		out.DescribeDBLogFiles = append(out.DescribeDBLogFiles, &rds.DescribeDBLogFilesDetails{
+			LogFileName: aws.String(name),
+			LastWritten: aws.Int64(f.lastWritten),
+			Size:        aws.Int64(int64(len(f.files[name]))),
+		})
+	}
+	return out, nil
+}
+
+func (f *fakeLogFiles) DownloadDBLogFilePortion(input *rds.DownloadDBLogFilePortionInput) (*rds.DownloadDBLogFilePortionOutput, error) {
+	data := f.files[aws.StringValue(input.LogFileName)]
+	offset, _ := strconv.Atoi(aws.StringValue(input.Marker))
+	if offset > len(data) {
+		offset = len(data)
+	}
+	if input.NumberOfLines != nil {
+		offset = len(data)
+	}
+	return &rds.DownloadDBLogFilePortionOutput{
+		LogFileData:           aws.String(data[offset:]),
+		Marker:                aws.String(strconv.Itoa(len(data))),
+		AdditionalDataPending: aws.Bool(false),
+	}, nil
+}
+
+func TestLogRotation(t *testing.T) {
+	tests := []struct {
+		name     string
+		steps    []func(f *fakeLogFiles)
+		expected []string
+	}{
+		{
+			name: "appended",
+			steps: []func(f *fakeLogFiles){
+				func(f *fakeLogFiles) { f.write(mysqlErrorLog, "b\n") },
+			},
+			expected: []string{"b"},
+		},
+		{
+			name: "rotated file appears along with the truncation",
+			steps: []func(f *fakeLogFiles){
+				func(f *fakeLogFiles) { f.write(mysqlErrorLog, "b\n") },
+				func(f *fakeLogFiles) {
+					f.write(mysqlErrorLog, "c\n")
+					f.rotate(mysqlErrorLog, 1, "d\n")
+				},
+			},
+			expected: []string{"b", "c", "d"},
+		},
+		{
+			name: "rotated file appears after the truncation",
+			steps: []func(f *fakeLogFiles){
+				func(f *fakeLogFiles) { f.write(mysqlErrorLog, "bbbb\n") },
+				func(f *fakeLogFiles) {
+					f.write(mysqlErrorLog, "c\n")
+					f.rotate(mysqlErrorLog, 1, "d\n")
+					delete(f.files, mysqlErrorLog+".1")
+				},
+				func(f *fakeLogFiles) {
+					f.files[mysqlErrorLog+".1"] = "a\nbbbb\nc\n"
+					f.write(mysqlErrorLog, "e\n")
+				},
+			},
+			expected: []string{"bbbb", "d", "c", "e"},
+		},
+		{
+			name: "rotated file is reused",
+			steps: []func(f *fakeLogFiles){
+				func(f *fakeLogFiles) { f.write(mysqlErrorLog, "bbbbbbbb\n") },
+				func(f *fakeLogFiles) { f.rotate(mysqlErrorLog, 1, "c\n") },
+				func(f *fakeLogFiles) { f.rotate(mysqlErrorLog, 1, "d\n") },
+			},
+			expected: []string{"bbbbbbbb", "c", "d"},
+		},
+		{
+			name: "mysql-error.log duplicating the running log is ignored",
+			steps: []func(f *fakeLogFiles){
+				func(f *fakeLogFiles) {
+					f.write("error/mysql-error.log", "b\n")
+					f.write(mysqlErrorLog, "b\n")
+				},
+			},
+			expected: []string{"b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeLogFiles{files: map[string]string{mysqlErrorLog: "a\n"}}
+			ch := make(chan logparser.LogEntry, 100)
+			r := &LogReader{
+				api:        api,
+				instanceId: aws.String("db"),
+				filePrefix: mysqlErrorLogPrefix,
+				rotating:   true,
+				logs:       map[string]*logFileMeta{},
+				ch:         ch,
+				logger:     logger.NewKlog("test"),
+			}
+			if err := r.refresh(true); err != nil {
+				t.Fatal(err)
+			}
+			for _, step := range tt.steps {
+				step(api)
+				if err := r.refresh(false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			close(ch)
+			var lines []string
+			for e := range ch {
+				lines = append(lines, e.Content)
+			}
+			if !reflect.DeepEqual(lines, tt.expected) {
+				t.Errorf("expected %s, got %s", strings.Join(tt.expected, ","), strings.Join(lines, ","))
+			}
+		})
+	}
+}
+
+func TestRotatedFrom(t *testing.T) {
+	r := &LogReader{rotating: true, logs: map[string]*logFileMeta{mysqlErrorLog: {}}}
+	tests := []struct {
+		fileName string
+		expected string
+	}{
+		{fileName: mysqlErrorLog + ".3", expected: mysqlErrorLog},
+		{fileName: mysqlErrorLog, expected: ""},
+		{fileName: "error/mysql-error.log.3", expected: ""},
+	}
+	for _, tt := range tests {
+		if got := r.rotatedFrom(tt.fileName); got != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.fileName, tt.expected, got)
+		}
+	}
+	r.rotating = false
+	if got := r.rotatedFrom(mysqlErrorLog + ".3"); got != "" {
+		t.Errorf("the files of non-rotating engines are not matched, got %q", got)
+	}
+}
+
+func TestLogResume(t *testing.T) {
+	tests := []struct {
+		name     string
+		savedAgo time.Duration
+		expected []string
+	}{
+		{name: "checkpoints within the catch-up window", savedAgo: time.Minute, expected: []string{"b", "c"}},
+		{name: "checkpoints older than the catch-up window", savedAgo: 2 * time.Hour, expected: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeLogFiles{files: map[string]string{mysqlErrorLog: "a\nb\nc\n"}, lastWritten: time.Now().UnixMilli()}
+			ch := make(chan logparser.LogEntry, 100)
+			r := &LogReader{
+				api:         api,
+				instanceId:  aws.String("db"),
+				filePrefix:  mysqlErrorLogPrefix,
+				rotating:    true,
+				logs:        map[string]*logFileMeta{},
+				ch:          ch,
+				catchUpFrom: time.Now().Add(-time.Hour),
+				resumeFrom: &LogCheckpoints{
+					SavedAt: time.Now().Add(-tt.savedAgo),
+					Files:   map[string]*LogCheckpoint{mysqlErrorLog: {Marker: "2", LastWritten: 1, Size: 2}},
+				},
+				logger: logger.NewKlog("test"),
+			}
+			if err := r.refresh(true); err != nil {
+				t.Fatal(err)
+			}
+			close(ch)
+			var lines []string
+			for e := range ch {
+				lines = append(lines, e.Content)
+			}
+			if !reflect.DeepEqual(lines, tt.expected) {
+				t.Errorf("expected %s, got %s", strings.Join(tt.expected, ","), strings.Join(lines, ","))
+			}
+		})
+	}
+}
@@ -0,0 +1,395 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/coroot/coroot-aws-agent/utils"
+	"github.com/coroot/logger"
+	"github.com/go-sql-driver/mysql"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	topQueriesLimit   = 20
+	queryTextMaxLen   = 256
+	picosecondsPerSec = 1e12
+)
+
+var (
+	dUp   = utils.Desc("mysql_up", "Whether the server is reachable")
+	dInfo = utils.Desc("mysql_info", "Server info", "server_version")
+
+	dConnectionsMax     = utils.Desc("mysql_connections_max", "The maximum permitted number of simultaneous client connections")
+	dConnectionsCurrent = utils.Desc("mysql_connections_current", "The number of currently open connections")
+	dConnectionsTotal   = utils.Desc("mysql_connections_total", "The number of connection attempts (successful or not) to the server")
+	dConnectionsAborted = utils.Desc("mysql_connections_aborted_total", "The number of failed attempts to connect to the server")
+	dThreadsRunning     = utils.Desc("mysql_threads_running", "The number of threads that are not sleeping")
+	dQueries            = utils.Desc("mysql_queries_total", "The number of statements executed by the server sent by clients")
+	dSlowQueries        = utils.Desc("mysql_slow_queries_total", "The number of queries that have taken more than long_query_time seconds")
+	dTrafficReceived    = utils.Desc("mysql_traffic_received_bytes_total", "The number of bytes received from all clients")
+	dTrafficSent        = utils.Desc("mysql_traffic_sent_bytes_total", "The number of bytes sent to all clients")
+
+	dInnodbBufferPoolSize  = utils.Desc("mysql_innodb_buffer_pool_size_bytes", "The size of the InnoDB buffer pool")
+	dInnodbBufferPoolBytes = utils.Desc("mysql_innodb_buffer_pool_bytes", "The amount of data in the InnoDB buffer pool", "state")
+	dInnodbReadRequests    = utils.Desc("mysql_innodb_buffer_pool_read_requests_total", "The number of logical read requests")
+	dInnodbDiskReads       = utils.Desc("mysql_innodb_buffer_pool_reads_total", "The number of logical reads that InnoDB could not satisfy from the buffer pool")
+	dInnodbRows            = utils.Desc("mysql_innodb_rows_total", "The number of rows operated in InnoDB tables", "operation")
+	dInnodbDataBytes       = utils.Desc("mysql_innodb_data_bytes_total", "The amount of data read or written by InnoDB", "operation")
+	dInnodbRowLockWaits    = utils.Desc("mysql_innodb_row_lock_waits_total", "The number of times operations on InnoDB tables had to wait for a row lock")
+	dInnodbRowLockTime     = utils.Desc("mysql_innodb_row_lock_time_seconds_total", "The total time spent in acquiring row locks for InnoDB tables")
+	dInnodbLogWaits        = utils.Desc("mysql_innodb_log_waits_total", "The number of times that the log buffer was too small and a wait was required for it to be flushed")
+
+	dReplicationIOStatus  = utils.Desc("mysql_replication_io_status", "Whether the replication I/O thread is running", "source_server", "state", "last_error")
+	dReplicationSQLStatus = utils.Desc("mysql_replication_sql_status", "Whether the replication SQL thread is running", "source_server", "state", "last_error")
+	dReplicationLag       = utils.Desc("mysql_replication_lag_seconds", "The replication lag", "source_server")
+
+	dTopQueryInfo         = utils.Desc("mysql_top_query_info", "The normalized text of the query, truncated", "schema", "digest", "query")
+	dTopQueryCalls        = utils.Desc("mysql_top_query_calls_total", "The number of times the query has been executed", "schema", "digest")
+	dTopQueryTime         = utils.Desc("mysql_top_query_time_seconds_total", "The total time spent executing the query", "schema", "digest")
+	dTopQueryLockTime     = utils.Desc("mysql_top_query_lock_time_seconds_total", "The total time spent waiting for table locks", "schema", "digest")
+	dTopQueryRowsExamined = utils.Desc("mysql_top_query_rows_examined_total", "The number of rows read from storage engines", "schema", "digest")
+)
+
+type Collector struct {
+	db             *sql.DB
+	scrapeInterval time.Duration
+	queryTimeout   time.Duration
+
+	metrics    []prometheus.Metric
+	tlsVersion string
+	err        error
+	lock       sync.RWMutex
+
+	stop   chan bool
+	logger logger.Logger
+}
+
+// New starts a collector, if password is not nil, it's called for every new connection to get a fresh IAM auth token
+func New(cfg *mysql.Config, password func() (string, error), scrapeInterval, queryTimeout time.Duration, logger logger.Logger) (*Collector, error) {
+	var connector driver.Connector = &passwordConnector{cfg: cfg, password: password}
+	if password == nil {
+		var err error
+		if connector, err = mysql.NewConnector(cfg); err != nil {
+			return nil, err
+		}
+	}
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(10 * time.Minute)
+	c := &Collector{
+		db:             db,
+		scrapeInterval: scrapeInterval,
+		queryTimeout:   queryTimeout,
+		stop:           make(chan bool),
+		logger:         logger,
+	}
+	go c.run()
+	return c, nil
+}
+
+func (c *Collector) run() {
+	c.snapshot()
+	t := time.NewTicker(c.scrapeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+			c.snapshot()
+		}
+	}
+}
+
+func (c *Collector) snapshot() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.queryTimeout)
+	defer cancel()
+
+	var metrics []prometheus.Metric
+	var tlsVersion string
+	err := c.db.PingContext(ctx)
+	if err != nil {
+		c.logger.Warning("failed to connect to mysql:", err)
+		metrics = append(metrics, utils.Gauge(dUp, 0))
+	} else {
+		metrics = append(metrics, utils.Gauge(dUp, 1))
+		metrics = append(metrics, c.status(ctx)...)
+		metrics = append(metrics, c.replicationStatus(ctx)...)
+		metrics = append(metrics, c.topQueries(ctx)...)
+		if s, err := c.keyValues(ctx, "SHOW SESSION STATUS LIKE 'Ssl_version'"); err == nil {
+			tlsVersion = s["Ssl_version"]
+		}
+	}
+
+	c.lock.Lock()
+	c.metrics = metrics
+	c.tlsVersion = tlsVersion
+	c.err = err
+	c.lock.Unlock()
+}
+
+// Err returns the error of the last attempt to connect to the server, nil until the first attempt is made
+func (c *Collector) Err() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.err
+}
+
+// TLSVersion returns the TLS version of the agent's connection, or an empty string if the connection is not encrypted
+func (c *Collector) TLSVersion() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.tlsVersion
+}
+
+func (c *Collector) status(ctx context.Context) []prometheus.Metric {
+	variables, err := c.keyValues(ctx, "SHOW GLOBAL VARIABLES")
+	if err != nil {
+		c.logger.Warning("failed to query global variables:", err)
+		return nil
+	}
+	status, err := c.keyValues(ctx, "SHOW GLOBAL STATUS")
+	if err != nil {
+		c.logger.Warning("failed to query global status:", err)
+		return nil
+	}
+	v := func(m map[string]string, name string) float64 {
+		f, _ := strconv.ParseFloat(m[name], 64)
+		return f
+	}
+	s := func(name string) float64 {
+		return v(status, name)
+	}
+	return []prometheus.Metric{
+		utils.Gauge(dInfo, 1, variables["version"]),
+
+		utils.Gauge(dConnectionsMax, v(variables, "max_connections")),
+		utils.Gauge(dConnectionsCurrent, s("Threads_connected")),
+		utils.Counter(dConnectionsTotal, s("Connections")),
+		utils.Counter(dConnectionsAborted, s("Aborted_connects")),
+		utils.Gauge(dThreadsRunning, s("Threads_running")),
+		utils.Counter(dQueries, s("Questions")),
+		utils.Counter(dSlowQueries, s("Slow_queries")),
+		utils.Counter(dTrafficReceived, s("Bytes_received")),
+		utils.Counter(dTrafficSent, s("Bytes_sent")),
+
+		utils.Gauge(dInnodbBufferPoolSize, v(variables, "innodb_buffer_pool_size")),
+		utils.Gauge(dInnodbBufferPoolBytes, s("Innodb_buffer_pool_bytes_data"), "data"),
+		utils.Gauge(dInnodbBufferPoolBytes, s("Innodb_buffer_pool_bytes_dirty"), "dirty"),
+		utils.Gauge(dInnodbBufferPoolBytes, s("Innodb_buffer_pool_pages_free")*v(variables, "innodb_page_size"), "free"),
+		utils.Counter(dInnodbReadRequests, s("Innodb_buffer_pool_read_requests")),
+		utils.Counter(dInnodbDiskReads, s("Innodb_buffer_pool_reads")),
+		utils.Counter(dInnodbRows, s("Innodb_rows_read"), "read"),
+		utils.Counter(dInnodbRows, s("Innodb_rows_inserted"), "inserted"),
+		utils.Counter(dInnodbRows, s("Innodb_rows_updated"), "updated"),
+		utils.Counter(dInnodbRows, s("Innodb_rows_deleted"), "deleted"),
+		utils.Counter(dInnodbDataBytes, s("Innodb_data_read"), "read"),
+		utils.Counter(dInnodbDataBytes, s("Innodb_data_written"), "written"),
+		utils.Counter(dInnodbRowLockWaits, s("Innodb_row_lock_waits")),
+		utils.Counter(dInnodbRowLockTime, s("Innodb_row_lock_time")/1000),
+		utils.Counter(dInnodbLogWaits, s("Innodb_log_waits")),
+	}
+}
+
+func (c *Collector) keyValues(ctx context.Context, query string) (map[string]string, error) {
+	rows, err := c.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := map[string]string{}
+	for rows.Next() {
+		var k string
+		var v sql.NullString
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		res[k] = v.String
+	}
+	return res, rows.Err()
+}
+
+func (c *Collector) replicationStatus(ctx context.Context) []prometheus.Metric {
+	// SHOW REPLICA STATUS is available since MySQL 8.0.22 and MariaDB 10.5.1
+	rs, err := c.rows(ctx, "SHOW REPLICA STATUS")
+	if err != nil {
+		if rs, err = c.rows(ctx, "SHOW SLAVE STATUS"); err != nil {
+			c.logger.Warning("failed to query replication status:", err)
+			return nil
+		}
+	}
+	var res []prometheus.Metric
+	for _, r := range rs {
+		get := func(names ...string) string {
+			for _, n := range names {
+				if v, ok := r[n]; ok {
+					return v
+				}
+			}
+			return ""
+		}
+		source := get("Source_Host", "Master_Host")
+		if source != "" {
+			source = net.JoinHostPort(source, get("Source_Port", "Master_Port"))
+		}
+		ioState := get("Replica_IO_Running", "Slave_IO_Running")
+		sqlState := get("Replica_SQL_Running", "Slave_SQL_Running")
+		res = append(res,
+			utils.Gauge(dReplicationIOStatus, boolToFloat(ioState == "Yes"), source, ioState, get("Last_IO_Error")),
+			utils.Gauge(dReplicationSQLStatus, boolToFloat(sqlState == "Yes"), source, sqlState, get("Last_SQL_Error")),
+		)
+		if lag, err := strconv.ParseFloat(get("Seconds_Behind_Source", "Seconds_Behind_Master"), 64); err == nil {
+			res = append(res, utils.Gauge(dReplicationLag, lag, source))
+		}
+	}
+	return res
+}
+
+func (c *Collector) rows(ctx context.Context, query string) ([]map[string]string, error) {
+	rows, err := c.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var res []map[string]string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		r := map[string]string{}
+		for i, col := range columns {
+			r[col] = values[i].String
+		}
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+func (c *Collector) topQueries(ctx context.Context) []prometheus.Metric {
+	rows, err := c.db.QueryContext(ctx, `
+		SELECT
+			IFNULL(SCHEMA_NAME, ''), IFNULL(DIGEST, ''), IFNULL(DIGEST_TEXT, ''),
+			COUNT_STAR, SUM_TIMER_WAIT, SUM_LOCK_TIME, SUM_ROWS_EXAMINED
+		FROM performance_schema.events_statements_summary_by_digest
+		ORDER BY SUM_TIMER_WAIT DESC
+		LIMIT ?`, topQueriesLimit)
+	if err != nil {
+		c.logger.Warning("failed to query performance_schema statement digests:", err)
+		return nil
+	}
+	defer rows.Close()
+	var res []prometheus.Metric
+	for rows.Next() {
+		var schema, digest, query string
+		var calls, timerWait, lockTime, rowsExamined float64
+		if err := rows.Scan(&schema, &digest, &query, &calls, &timerWait, &lockTime, &rowsExamined); err != nil {
+			c.logger.Warning(err)
+			return nil
+		}
+		if len(query) > queryTextMaxLen {
+			// the cut may split a multibyte character, label values must be valid UTF-8
+			query = strings.ToValidUTF8(query[:queryTextMaxLen], "") + "..."
+		}
+		res = append(res,
+			utils.Gauge(dTopQueryInfo, 1, schema, digest, query),
+			utils.Counter(dTopQueryCalls, calls, schema, digest),
+			utils.Counter(dTopQueryTime, timerWait/picosecondsPerSec, schema, digest),
+			utils.Counter(dTopQueryLockTime, lockTime/picosecondsPerSec, schema, digest),
+			utils.Counter(dTopQueryRowsExamined, rowsExamined, schema, digest),
+		)
+	}
+	if err := rows.Err(); err != nil {
+		c.logger.Warning(err)
+	}
+	return res
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for _, m := range c.metrics {
+		ch <- m
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dUp
+	ch <- dInfo
+	ch <- dConnectionsMax
+	ch <- dConnectionsCurrent
+	ch <- dConnectionsTotal
+	ch <- dConnectionsAborted
+	ch <- dThreadsRunning
+	ch <- dQueries
+	ch <- dSlowQueries
+	ch <- dTrafficReceived
+	ch <- dTrafficSent
+	ch <- dInnodbBufferPoolSize
+	ch <- dInnodbBufferPoolBytes
+	ch <- dInnodbReadRequests
+	ch <- dInnodbDiskReads
+	ch <- dInnodbRows
+	ch <- dInnodbDataBytes
+	ch <- dInnodbRowLockWaits
+	ch <- dInnodbRowLockTime
+	ch <- dInnodbLogWaits
+	ch <- dReplicationIOStatus
+	ch <- dReplicationSQLStatus
+	ch <- dReplicationLag
+	ch <- dTopQueryInfo
+	ch <- dTopQueryCalls
+	ch <- dTopQueryTime
+	ch <- dTopQueryLockTime
+	ch <- dTopQueryRowsExamined
+}
+
+func (c *Collector) Close() error {
+	close(c.stop)
+	return c.db.Close()
+}
+
+type passwordConnector struct {
+	cfg      *mysql.Config
+	password func() (string, error)
+}
+
+func (c *passwordConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	password, err := c.password()
+	if err != nil {
+		return nil, err
+	}
+	cfg := c.cfg.Clone()
+	cfg.Passwd = password
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+func (c *passwordConnector) Driver() driver.Driver {
+	return mysql.MySQLDriver{}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
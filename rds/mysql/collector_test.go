@@ -0,0 +1,299 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/coroot/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// fakeResult is the response to a query, the rows beyond the LIMIT argument are cut like the server does
+type fakeResult struct {
+	columns []string
+	rows    [][]driver.Value
+	err     error
+}
+
+// fakeConnector serves the queries by their normalized text, unknown queries fail
+type fakeConnector struct {
+	results map[string]fakeResult
+	queries []string
+}
+
+func (c *fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{c: c}, nil
+}
+
+func (c *fakeConnector) Driver() driver.Driver {
+	return nil
+}
+
+type fakeConn struct {
+	c *fakeConnector
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	query = strings.Join(strings.Fields(query), " ")
+	c.c.queries = append(c.c.queries, query)
+	for prefix, r := range c.c.results {
+		if !strings.HasPrefix(query, prefix) {
+			continue
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		rows := r.rows
+		if strings.HasSuffix(query, "LIMIT ?") && len(args) == 1 {
+			if limit := int(args[0].Value.(int64)); len(rows) > limit {
+				rows = rows[:limit]
+			}
+		}
+		return &fakeRows{columns: r.columns, rows: rows}, nil
+	}
+	return nil, fmt.Errorf("unexpected query: %s", query)
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func newTestCollector(results map[string]fakeResult) (*Collector, *fakeConnector) {
+	connector := &fakeConnector{results: results}
+	return &Collector{db: sql.OpenDB(connector), queryTimeout: time.Second, logger: logger.NewKlog("test")}, connector
+}
+
+var fqNameRe = regexp.MustCompile(`fqName: "([^"]+)"`)
+
+// values returns the metric values by name{label="value",...}
+func values(t *testing.T, metrics []prometheus.Metric) map[string]float64 {
+	res := map[string]float64{}
+	for _, m := range metrics {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		var labels []string
+		for _, l := range pb.Label {
+			labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+		}
+		sort.Strings(labels)
+		key := fqNameRe.FindStringSubmatch(m.Desc().String())[1] + "{" + strings.Join(labels, ",") + "}"
+		switch {
+		case pb.Gauge != nil:
+			res[key] = pb.Gauge.GetValue()
+		case pb.Counter != nil:
+			res[key] = pb.Counter.GetValue()
+		}
+	}
+	return res
+}
+
+func keyValueRows(kv ...interface{}) [][]driver.Value {
+	var rows [][]driver.Value
+	for i := 0; i < len(kv); i += 2 {
+		rows = append(rows, []driver.Value{kv[i], kv[i+1]})
+	}
+	return rows
+}
+
+func TestStatus(t *testing.T) {
+	c, _ := newTestCollector(map[string]fakeResult{
+		"SHOW GLOBAL VARIABLES": {columns: []string{"Variable_name", "Value"}, rows: keyValueRows(
+			"version", "8.0.35",
+			"max_connections", "150",
+			"innodb_page_size", "16384",
+			"innodb_buffer_pool_size", "134217728",
+			"init_connect", nil,
+		)},
+		"SHOW GLOBAL STATUS": {columns: []string{"Variable_name", "Value"}, rows: keyValueRows(
+			"Threads_connected", "7",
+			"Questions", []byte("1000"),
+			"Innodb_buffer_pool_pages_free", "10",
+			"Innodb_row_lock_time", "2500",
+		)},
+	})
+	got := values(t, c.status(context.Background()))
+	expected := map[string]float64{
+		`mysql_info{server_version="8.0.35"}`:                1,
+		`mysql_connections_max{}`:                            150,
+		`mysql_connections_current{}`:                        7,
+		`mysql_queries_total{}`:                              1000,
+		`mysql_innodb_buffer_pool_size_bytes{}`:              134217728,
+		`mysql_innodb_buffer_pool_bytes{state="free"}`:       10 * 16384,
+		`mysql_innodb_row_lock_time_seconds_total{}`:         2.5,
+		`mysql_innodb_buffer_pool_read_requests_total{}`:     0,
+		`mysql_innodb_rows_total{operation="inserted"}`:      0,
+		`mysql_innodb_data_bytes_total{operation="written"}`: 0,
+	}
+	for k, v := range expected {
+		if got[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, got[k])
+		}
+	}
+
+	c, _ = newTestCollector(map[string]fakeResult{
+		"SHOW GLOBAL VARIABLES": {err: fmt.Errorf("access denied")},
+	})
+	if got := c.status(context.Background()); got != nil {
+		t.Errorf("expected no metrics if the variables can't be queried, got %d", len(got))
+	}
+}
+
+func TestReplicationStatus(t *testing.T) {
+	replica := fakeResult{
+		columns: []string{"Source_Host", "Source_Port", "Replica_IO_Running", "Replica_SQL_Running", "Last_IO_Error", "Last_SQL_Error", "Seconds_Behind_Source"},
+		rows:    [][]driver.Value{{"10.0.0.1", "3306", "Yes", "No", "", "Error 1062", "12"}},
+	}
+	slave := fakeResult{
+		columns: []string{"Master_Host", "Master_Port", "Slave_IO_Running", "Slave_SQL_Running", "Last_IO_Error", "Last_SQL_Error", "Seconds_Behind_Master"},
+		rows:    [][]driver.Value{{"10.0.0.1", "3306", "Connecting", "Yes", "error connecting to master", "", nil}},
+	}
+	syntaxErr := fakeResult{err: fmt.Errorf("Error 1064: You have an error in your SQL syntax")}
+
+	tests := []struct {
+		name     string
+		results  map[string]fakeResult
+		expected map[string]float64
+		queries  []string
+	}{
+		{
+			name:    "SHOW REPLICA STATUS",
+			results: map[string]fakeResult{"SHOW REPLICA STATUS": replica},
+			expected: map[string]float64{
+				`mysql_replication_io_status{last_error="",source_server="10.0.0.1:3306",state="Yes"}`:           1,
+				`mysql_replication_sql_status{last_error="Error 1062",source_server="10.0.0.1:3306",state="No"}`: 0,
+				`mysql_replication_lag_seconds{source_server="10.0.0.1:3306"}`:                                   12,
+			},
+			queries: []string{"SHOW REPLICA STATUS"},
+		},
+		{
+			name:    "fallback to SHOW SLAVE STATUS, no lag while the IO thread is connecting",
+			results: map[string]fakeResult{"SHOW REPLICA STATUS": syntaxErr, "SHOW SLAVE STATUS": slave},
+			expected: map[string]float64{
+				`mysql_replication_io_status{last_error="error connecting to master",source_server="10.0.0.1:3306",state="Connecting"}`: 0,
+				`mysql_replication_sql_status{last_error="",source_server="10.0.0.1:3306",state="Yes"}`:                                 1,
+			},
+			queries: []string{"SHOW REPLICA STATUS", "SHOW SLAVE STATUS"},
+		},
+		{
+			name:     "not a replica",
+			results:  map[string]fakeResult{"SHOW REPLICA STATUS": {columns: replica.columns}},
+			expected: map[string]float64{},
+			queries:  []string{"SHOW REPLICA STATUS"},
+		},
+		{
+			name:     "both statements fail",
+			results:  map[string]fakeResult{"SHOW REPLICA STATUS": syntaxErr, "SHOW SLAVE STATUS": {err: fmt.Errorf("access denied")}},
+			expected: map[string]float64{},
+			queries:  []string{"SHOW REPLICA STATUS", "SHOW SLAVE STATUS"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, connector := newTestCollector(tt.results)
+			got := values(t, c.replicationStatus(context.Background()))
+			if fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+			if fmt.Sprint(connector.queries) != fmt.Sprint(tt.queries) {
+				t.Errorf("expected queries %v, got %v", tt.queries, connector.queries)
+			}
+		})
+	}
+}
+
+func TestTopQueries(t *testing.T) {
+	var rows [][]driver.Value
+	for i := 0; i < 25; i++ {
+		query := fmt.Sprintf("SELECT * FROM t%d WHERE id = ?", i)
+		if i == 0 {
+			query = "SELECT '" + strings.Repeat("é", queryTextMaxLen) + "'"
+		}
+		rows = append(rows, []driver.Value{"app", fmt.Sprintf("digest%d", i), query, int64(10), int64(3e12), int64(5e11), int64(100)})
+	}
+	c, _ := newTestCollector(map[string]fakeResult{
+		"SELECT IFNULL(SCHEMA_NAME, '')": {
+			columns: []string{"SCHEMA_NAME", "DIGEST", "DIGEST_TEXT", "COUNT_STAR", "SUM_TIMER_WAIT", "SUM_LOCK_TIME", "SUM_ROWS_EXAMINED"},
+			rows:    rows,
+		},
+	})
+	metrics := c.topQueries(context.Background())
+	got := values(t, metrics)
+
+	digests := map[string]bool{}
+	for _, m := range metrics {
+		var pb dto.Metric
+		_ = m.Write(&pb)
+		for _, l := range pb.Label {
+			switch l.GetName() {
+			case "digest":
+				digests[l.GetValue()] = true
+			case "query":
+				if !utf8.ValidString(l.GetValue()) {
+					t.Errorf("the query text is not valid UTF-8: %q", l.GetValue())
+				}
+				if len(l.GetValue()) > queryTextMaxLen+len("...") {
+					t.Errorf("the query text is not truncated: %d bytes", len(l.GetValue()))
+				}
+			}
+		}
+	}
+	if len(digests) != topQueriesLimit {
+		t.Errorf("expected %d digests, got %d", topQueriesLimit, len(digests))
+	}
+	if digests["digest20"] {
+		t.Error("the digests beyond the limit must not be exported")
+	}
+	expected := map[string]float64{
+		`mysql_top_query_calls_total{digest="digest1",schema="app"}`:                                10,
+		`mysql_top_query_time_seconds_total{digest="digest1",schema="app"}`:                         3,
+		`mysql_top_query_lock_time_seconds_total{digest="digest1",schema="app"}`:                    0.5,
+		`mysql_top_query_rows_examined_total{digest="digest1",schema="app"}`:                        100,
+		`mysql_top_query_info{digest="digest1",query="SELECT * FROM t1 WHERE id = ?",schema="app"}`: 1,
+	}
+	for k, v := range expected {
+		if got[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, got[k])
+		}
+	}
+}
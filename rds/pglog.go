@@ -0,0 +1,216 @@
+package rds
+
+import (
+	"fmt"
+	"github.com/coroot/logparser"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type logRecord struct {
+	Timestamp time.Time
+	Client    string
+	User      string
+	Database  string
+	Pid       int
+	Severity  string
+	Level     logparser.Level
+	Message   string
+}
+
+func (r *logRecord) content() string {
+	if r.Severity == "" {
+		return r.Message
+	}
+	return r.Severity + ":  " + r.Message
+}
+
+var pgPrefixEscapes = map[byte]string{
+	'a': `(?P<app>.*?)`,
+	'u': `(?P<user>.*?)`,
+	'd': `(?P<db>.*?)`,
+	'r': `(?P<client>\S*?)`,
+	'h': `(?P<client>\S*?)`,
+	'b': `.*?`,
+	'p': `(?P<pid>\d+)`,
+	'P': `\d*`,
+	't': `(?P<ts>\d{4}-\d\d-\d\d \d\d:\d\d:\d\d(?: \w+)?)`,
+	'm': `(?P<tsms>\d{4}-\d\d-\d\d \d\d:\d\d:\d\d\.\d+(?: \w+)?)`,
+	'n': `\d+\.\d+`,
+	'i': `.*?`,
+	'e': `\w*`,
+	'c': `[\da-f.]*`,
+	'l': `\d*`,
+	's': `\d{4}-\d\d-\d\d \d\d:\d\d:\d\d(?: \w+)?`,
+	'v': `\S*?`,
+	'x': `\d*`,
+	'Q': `-?\d*`,
+	'q': ``,
+}
+
+var pgSeverities = map[string]logparser.Level{
+	"DEBUG":   logparser.LevelDebug,
+	"DEBUG1":  logparser.LevelDebug,
+	"DEBUG2":  logparser.LevelDebug,
+	"DEBUG3":  logparser.LevelDebug,
+	"DEBUG4":  logparser.LevelDebug,
+	"DEBUG5":  logparser.LevelDebug,
+	"INFO":    logparser.LevelInfo,
+	"NOTICE":  logparser.LevelInfo,
+	"LOG":     logparser.LevelInfo,
+	"WARNING": logparser.LevelWarning,
+	"ERROR":   logparser.LevelError,
+	"FATAL":   logparser.LevelCritical,
+	"PANIC":   logparser.LevelCritical,
+}
+
+var namedGroupRe = regexp.MustCompile(`\(\?P<\w+>`)
+
+// these messages complement the previous one, so they are merged into it
+var pgContinuationSeverities = map[string]bool{
+	"DETAIL":    true,
+	"HINT":      true,
+	"CONTEXT":   true,
+	"STATEMENT": true,
+	"QUERY":     true,
+	"LOCATION":  true,
+}
+
+// pgLogParser parses Postgres log lines according to log_line_prefix and merges multi-line entries.
+// A record may be split between log file portions, so it's kept pending until the next record starts or it gets stale.
+type pgLogParser struct {
+	re *regexp.Regexp
+
+	pending        *logRecord
+	pendingUpdated time.Time
+}
+
+func newPgLogParser(prefix string) (*pgLogParser, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	seen := map[string]bool{}
+	for i := 0; i < len(prefix); i++ {
+		if prefix[i] != '%' || i == len(prefix)-1 {
+			expr.WriteString(regexp.QuoteMeta(prefix[i : i+1]))
+			continue
+		}
+		i++
+		if prefix[i] == '%' {
+			expr.WriteString("%")
+			continue
+		}
+		e, ok := pgPrefixEscapes[prefix[i]]
+		if !ok {
+			return nil, fmt.Errorf("unsupported log_line_prefix escape: %%%c", prefix[i])
+		}
+		// a named group can be used only once
+		if name := groupName(e); name != "" {
+			if seen[name] {
+				e = namedGroupRe.ReplaceAllString(e, "(?:")
+			}
+			seen[name] = true
+		}
+		expr.WriteString(e)
+	}
+	expr.WriteString(`\s*(?P<severity>[A-Z][A-Z0-9]*):\s+(?P<message>.*)$`)
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, err
+	}
+	return &pgLogParser{re: re}, nil
+}
+
+func groupName(expr string) string {
+	if !strings.HasPrefix(expr, "(?P<") {
+		return ""
+	}
+	return expr[4:strings.Index(expr, ">")]
+}
+
+// feed parses a line and returns the previous record if the line starts a new one
+func (p *pgLogParser) feed(line string) *logRecord {
+	r := p.parse(line)
+	switch {
+	case r == nil && p.pending == nil:
+		return &logRecord{Message: line, Level: orphanLevel(line)}
+	case r == nil:
+		p.pending.Message += "\n" + line
+		p.pendingUpdated = time.Now()
+		return nil
+	case pgContinuationSeverities[r.Severity] && p.pending != nil && p.pending.Pid == r.Pid:
+		p.pending.Message += "\n" + r.content()
+		p.pendingUpdated = time.Now()
+		return nil
+	case pgContinuationSeverities[r.Severity]:
+		// the record it complements has been lost, e.g. it was written before the reader started
+		r.Level = orphanLevel(r.Message)
+	}
+	prev := p.pending
+	p.pending = r
+	p.pendingUpdated = time.Now()
+	return prev
+}
+
+// flushStale returns the record being assembled if it hasn't been continued for the given time
+func (p *pgLogParser) flushStale(timeout time.Duration) *logRecord {
+	if p.pending == nil || time.Since(p.pendingUpdated) < timeout {
+		return nil
+	}
+	r := p.pending
+	p.pending = nil
+	return r
+}
+
+// orphanLevel returns the level of a line not belonging to any record
+func orphanLevel(line string) logparser.Level {
+	if level := logparser.GuessLevel(line); level != logparser.LevelUnknown {
+		return level
+	}
+	return logparser.LevelInfo
+}
+
+func (p *pgLogParser) parse(line string) *logRecord {
+	m := p.re.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	r := &logRecord{}
+	for i, name := range p.re.SubexpNames() {
+		v := m[i]
+		switch name {
+		case "ts", "tsms":
+			r.Timestamp = parsePgTimestamp(v)
+		case "client":
+			r.Client = v
+		case "user":
+			r.User = v
+		case "db":
+			r.Database = v
+		case "pid":
+			r.Pid, _ = strconv.Atoi(v)
+		case "severity":
+			r.Severity = v
+		case "message":
+			r.Message = v
+		}
+	}
+	level, ok := pgSeverities[r.Severity]
+	if !ok && !pgContinuationSeverities[r.Severity] {
+		return nil // the message itself looks like a prefix
+	}
+	r.Level = level
+	return r
+}
+
+// parsePgTimestamp parses the %t and %m timestamps, the zone is omitted if log_timezone is set to an offset,
+// in that case the timestamp is treated as UTC which is the default log_timezone on RDS
+func parsePgTimestamp(v string) time.Time {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999 MST", "2006-01-02 15:04:05.999999999"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
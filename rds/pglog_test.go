@@ -0,0 +1,102 @@
+package rds
+
+import (
+	"github.com/coroot/logparser"
+	"testing"
+	"time"
+)
+
+func TestPgLogParserFeed(t *testing.T) {
+	const prefix = "2024-01-03 10:00:00 UTC:10.0.0.5(41002):app@orders:"
+	tests := []struct {
+		name     string
+		lines    []string
+		expected []logRecord
+	}{
+		{
+			name:  "single record",
+			lines: []string{prefix + "[123]:ERROR:  relation \"x\" does not exist"},
+			expected: []logRecord{
+				{User: "app", Database: "orders", Pid: 123, Severity: "ERROR", Level: logparser.LevelError, Message: "relation \"x\" does not exist"},
+			},
+		},
+		{
+			name: "continuation merged",
+			lines: []string{
+				prefix + "[123]:ERROR:  relation \"x\" does not exist",
+				prefix + "[123]:STATEMENT:  select * from x",
+			},
+			expected: []logRecord{
+				{User: "app", Database: "orders", Pid: 123, Severity: "ERROR", Level: logparser.LevelError, Message: "relation \"x\" does not exist\nSTATEMENT:  select * from x"},
+			},
+		},
+		{
+			name: "multi-line message",
+			lines: []string{
+				prefix + "[123]:LOG:  duration: 1.5 ms  statement: select 1",
+				"\tfrom t",
+			},
+			expected: []logRecord{
+				{User: "app", Database: "orders", Pid: 123, Severity: "LOG", Level: logparser.LevelInfo, Message: "duration: 1.5 ms  statement: select 1\n\tfrom t"},
+			},
+		},
+		{
+			name: "new record emits the previous one",
+			lines: []string{
+				prefix + "[123]:WARNING:  there is no transaction in progress",
+				prefix + "[124]:FATAL:  password authentication failed for user \"app\"",
+			},
+			expected: []logRecord{
+				{User: "app", Database: "orders", Pid: 123, Severity: "WARNING", Level: logparser.LevelWarning, Message: "there is no transaction in progress"},
+				{User: "app", Database: "orders", Pid: 124, Severity: "FATAL", Level: logparser.LevelCritical, Message: "password authentication failed for user \"app\""},
+			},
+		},
+		{
+			name: "continuation of another process",
+			lines: []string{
+				prefix + "[123]:ERROR:  deadlock detected",
+				prefix + "[124]:DETAIL:  Process 124 waits for ShareLock",
+			},
+			expected: []logRecord{
+				{User: "app", Database: "orders", Pid: 123, Severity: "ERROR", Level: logparser.LevelError, Message: "deadlock detected"},
+				{User: "app", Database: "orders", Pid: 124, Severity: "DETAIL", Level: logparser.LevelInfo, Message: "Process 124 waits for ShareLock"},
+			},
+		},
+		{
+			name:  "orphan line",
+			lines: []string{"----------------------- END OF LOG ----------------------"},
+			expected: []logRecord{
+				{Level: logparser.LevelInfo, Message: "----------------------- END OF LOG ----------------------"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newPgLogParser("%t:%r:%u@%d:[%p]:")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var records []*logRecord
+			for _, l := range tt.lines {
+				if r := p.feed(l); r != nil {
+					records = append(records, r)
+				}
+			}
+			if r := p.flushStale(0); r != nil {
+				records = append(records, r)
+			}
+			if len(records) != len(tt.expected) {
+				t.Fatalf("expected %d records, got %d", len(tt.expected), len(records))
+			}
+			for i, r := range records {
+				e := tt.expected[i]
+				if r.User != e.User || r.Database != e.Database || r.Pid != e.Pid || r.Severity != e.Severity || r.Level != e.Level || r.Message != e.Message {
+					t.Errorf("expected %+v, got %+v", e, *r)
+				}
+				if e.Severity != "" && !r.Timestamp.Equal(time.Date(2024, 1, 3, 10, 0, 0, 0, time.UTC)) {
+					t.Errorf("unexpected timestamp: %s", r.Timestamp)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package rds
+
+import (
+	"github.com/coroot/coroot-aws-agent/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	slowQueryMaxLen      = 4096
+	slowQueryOther       = "<other>"
+	slowQueryIdleTimeout = time.Hour // a fingerprint not seen for this time gives its place to a new one
+)
+
+var (
+	dSlowQueryDuration = utils.Desc("aws_rds_slow_query_duration_seconds",
+		"Duration of the queries logged according to log_min_duration_statement",
+		"db", "user", "query")
+
+	slowQueryBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+	durationRe = regexp.MustCompile(`(?s)^duration: ([\d.]+) ms\s+(?:statement|execute [^:]*): (.*)$`)
+
+	commentsRe   = regexp.MustCompile(`(?s)/\*.*?\*/|--[^\n]*`)
+	stringsRe    = regexp.MustCompile(`(?s)E?'(?:[^']|'')*'|\$\$.*?\$\$`)
+	numbersRe    = regexp.MustCompile(`\b\d+(?:\.\d+)?(?:[eE][-+]?\d+)?\b|\$\d+`)
+	valueListsRe = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	valuesRowsRe = regexp.MustCompile(`(?i)(values\s*\(\.\.\.\))(?:\s*,\s*\(\.\.\.\))+`)
+	spacesRe     = regexp.MustCompile(`\s+`)
+)
+
+// normalizeQuery converts a query into its fingerprint by replacing literals with placeholders
+func normalizeQuery(query string) string {
+	q := commentsRe.ReplaceAllString(query, " ")
+	q = stringsRe.ReplaceAllString(q, "?")
+	q = numbersRe.ReplaceAllString(q, "?")
+	q = valueListsRe.ReplaceAllString(q, "(...)")
+	q = valuesRowsRe.ReplaceAllString(q, "$1")
+	q = spacesRe.ReplaceAllString(q, " ")
+	q = strings.TrimSuffix(strings.TrimSpace(q), ";")
+	q = strings.ToLower(q)
+	if len(q) > slowQueryMaxLen {
+		q = q[:slowQueryMaxLen]
+	}
+	return q
+}
+
+type slowQueryKey struct {
+	db    string
+	user  string
+	query string
+}
+
+type slowQueryStat struct {
+	count    uint64
+	sum      float64
+	buckets  []uint64
+	lastSeen time.Time
+}
+
+// slowQueries aggregates the durations of the queries found in Postgres logs.
+// The number of fingerprints is limited: once the limit is reached, a new fingerprint takes the place of an idle one
+// or is accounted as <other>, so the exported series don't churn and their counters never reset.
+type slowQueries struct {
+	limit int
+	stats map[slowQueryKey]*slowQueryStat
+	other *slowQueryStat
+	lock  sync.Mutex
+}
+
+func newSlowQueries(limit int) *slowQueries {
+	return &slowQueries{limit: limit, stats: map[slowQueryKey]*slowQueryStat{}}
+}
+
+func (s *slowQueries) observe(r *logRecord) {
+	if r.Severity != "LOG" {
+		return
+	}
+	m := durationRe.FindStringSubmatch(r.Message)
+	if m == nil {
+		return
+	}
+	ms, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return
+	}
+	duration := ms / 1000
+	key := slowQueryKey{db: r.Database, user: r.User, query: normalizeQuery(stripContinuations(m[2]))}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	stat := s.stats[key]
+	if stat == nil && (len(s.stats) < s.limit || s.evictIdle(now)) {
+		stat = &slowQueryStat{buckets: make([]uint64, len(slowQueryBuckets))}
+		s.stats[key] = stat
+	}
+	if stat == nil {
+		if s.other == nil {
+			s.other = &slowQueryStat{buckets: make([]uint64, len(slowQueryBuckets))}
+		}
+		stat = s.other
+	}
+	stat.count++
+	stat.sum += duration
+	stat.lastSeen = now
+	for i, b := range slowQueryBuckets {
+		if duration <= b {
+			stat.buckets[i]++
+		}
+	}
+}
+
+// evictIdle removes the least recently seen fingerprint if it has been idle for slowQueryIdleTimeout
+func (s *slowQueries) evictIdle(now time.Time) bool {
+	var oldest *slowQueryKey
+	var oldestSeen time.Time
+	for k, stat := range s.stats {
+		if oldest == nil || stat.lastSeen.Before(oldestSeen) {
+			k := k
+			oldest, oldestSeen = &k, stat.lastSeen
+		}
+	}
+	if oldest == nil || now.Sub(oldestSeen) < slowQueryIdleTimeout {
+		return false
+	}
+	delete(s.stats, *oldest)
+	return true
+}
+
+func (s *slowQueries) collect(ch chan<- prometheus.Metric) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for k, stat := range s.stats {
+		ch <- stat.histogram(k.db, k.user, k.query)
+	}
+	if s.other != nil {
+		ch <- s.other.histogram("", "", slowQueryOther)
+	}
+}
+
+func (stat *slowQueryStat) histogram(labels ...string) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(slowQueryBuckets))
+	for i, b := range slowQueryBuckets {
+		buckets[b] = stat.buckets[i]
+	}
+	return utils.Histogram(dSlowQueryDuration, stat.count, stat.sum, buckets, labels...)
+}
+
+// stripContinuations removes the merged DETAIL, CONTEXT, etc. messages
+func stripContinuations(message string) string {
+	lines := strings.Split(message, "\n")
+	for i, l := range lines {
+		if i == 0 {
+			continue
+		}
+		if severity, _, ok := strings.Cut(l, ":"); ok && pgContinuationSeverities[severity] {
+			return strings.Join(lines[:i], "\n")
+		}
+	}
+	return message
+}
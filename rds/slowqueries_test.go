@@ -0,0 +1,50 @@
+package rds
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeQuery(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{
+			query:    "SELECT * FROM users WHERE id = 42",
+			expected: "select * from users where id = ?",
+		},
+		{
+			query:    "select * from t1 where name = 'O''Brien' and x = $1",
+			expected: "select * from t1 where name = ? and x = ?",
+		},
+		{
+			query:    "SELECT * FROM t WHERE id IN (1, 2, 3)",
+			expected: "select * from t where id in (...)",
+		},
+		{
+			query:    "insert into t (a, b) values (1, 'x'), (2, 'y');",
+			expected: "insert into t (a, b) values (...)",
+		},
+		{
+			query:    "select 1 /* comment */ -- trailing\n  from t",
+			expected: "select ? from t",
+		},
+		{
+			query:    "select -1.5e3, E'a\\n', $$body$$",
+			expected: "select -?, ?, ?",
+		},
+		{
+			query:    "select a-1 from t",
+			expected: "select a-? from t",
+		},
+	}
+	for _, tt := range tests {
+		if got := normalizeQuery(tt.query); got != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.query, tt.expected, got)
+		}
+	}
+	if got := normalizeQuery("select " + strings.Repeat("a", 2*slowQueryMaxLen)); len(got) != slowQueryMaxLen {
+		t.Errorf("expected the fingerprint to be truncated to %d bytes, got %d", slowQueryMaxLen, len(got))
+	}
+}
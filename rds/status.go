@@ -0,0 +1,53 @@
+package rds
+
+import (
+	"github.com/coroot/coroot-aws-agent/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"sync"
+	"time"
+)
+
+var dStatusDuration = utils.Desc("aws_rds_status_duration_seconds", "Total time the RDS instance has spent in each status", "status")
+
+// collectable reports whether the instance accepts connections in the given status.
+// The instance keeps serving queries while it's being backed up or reconfigured, so the collectors keep running.
+func collectable(status string) bool {
+	return status == "available" || status == "backing-up" || strings.HasPrefix(status, "configuring-")
+}
+
+// statusTracker accumulates the time spent in each status
+type statusTracker struct {
+	current   string
+	since     time.Time
+	durations map[string]time.Duration
+	lock      sync.Mutex
+}
+
+func newStatusTracker(status string) *statusTracker {
+	return &statusTracker{current: status, since: time.Now(), durations: map[string]time.Duration{}}
+}
+
+// update switches the tracker to the given status and returns the previous one
+func (t *statusTracker) update(status string) string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	prev := t.current
+	t.durations[prev] += now.Sub(t.since)
+	t.current = status
+	t.since = now
+	return prev
+}
+
+func (t *statusTracker) collect(ch chan<- prometheus.Metric) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	durations := map[string]time.Duration{t.current: time.Since(t.since)}
+	for status, d := range t.durations {
+		durations[status] += d
+	}
+	for status, d := range durations {
+		ch <- utils.Counter(dStatusDuration, d.Seconds(), status)
+	}
+}
@@ -0,0 +1,163 @@
+package rds
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	_ "embed"
+	"fmt"
+	"github.com/coroot/coroot-aws-agent/flags"
+	"github.com/lib/pq"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//go:embed global-bundle.pem
+var embeddedCaBundle []byte
+
+var (
+	caBundlePath     string
+	caBundlePathErr  error
+	caBundlePathOnce sync.Once
+)
+
+// sslMode returns the effective SSL mode for the DB connection
+func (c *Collector) sslMode() string {
+	mode := *flags.RdsDbSslMode
+	if mode == "disable" && c.iamAuthEnabled() {
+		mode = "require" // IAM authentication requires SSL
+	}
+	return mode
+}
+
+// caBundleFile returns the path to the CA bundle: either the one specified by the flag
+// or the embedded one written to a temporary file, since lib/pq reads sslrootcert from disk.
+func caBundleFile() (string, error) {
+	if *flags.RdsDbCaBundle != "" {
+		return *flags.RdsDbCaBundle, nil
+	}
+	caBundlePathOnce.Do(func() {
+		if !x509.NewCertPool().AppendCertsFromPEM(embeddedCaBundle) {
+			caBundlePathErr = fmt.Errorf("the embedded RDS CA bundle contains no certificates, use --rds-db-ca-bundle")
+			return
+		}
+		caBundlePath = filepath.Join(os.TempDir(), "coroot-aws-agent-rds-ca-bundle.pem")
+		caBundlePathErr = os.WriteFile(caBundlePath, embeddedCaBundle, 0644)
+	})
+	return caBundlePath, caBundlePathErr
+}
+
+func caCertPool() (*x509.CertPool, error) {
+	path, err := caBundleFile()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// tlsConfig builds a TLS config for the given SSL mode.
+// serverName is the endpoint hostname, since the agent connects to the resolved IP.
+func tlsConfig(mode, serverName string) (*tls.Config, error) {
+	switch mode {
+	case "require":
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	case "verify-ca", "verify-full":
+		roots, err := caCertPool()
+		if err != nil {
+			return nil, err
+		}
+		if mode == "verify-full" {
+			return &tls.Config{RootCAs: roots, ServerName: serverName}, nil
+		}
+		return &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				return verifyChain(rawCerts, roots)
+			},
+		}, nil
+	}
+	return nil, nil
+}
+
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no server certificate")
+	}
+	opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+	var leaf *x509.Certificate
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			leaf = cert
+			continue
+		}
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(opts)
+	return err
+}
+
+// pgTLSParams returns the DSN parameters for lib/pq
+func pgTLSParams(mode string) (string, error) {
+	switch mode {
+	case "disable", "require":
+		return "&sslmode=" + mode, nil
+	}
+	path, err := caBundleFile()
+	if err != nil {
+		return "", err
+	}
+	return "&sslmode=" + mode + "&sslrootcert=" + path, nil
+}
+
+// pgConnector connects to the given address regardless of the DSN host,
+// so lib/pq verifies the server certificate against the hostname while the agent connects to the resolved IP.
+type pgConnector struct {
+	dsn  string
+	addr string
+}
+
+func (c pgConnector) Connect(context.Context) (driver.Conn, error) {
+	return pq.DialOpen(addrDialer{addr: c.addr}, c.dsn)
+}
+
+func (c pgConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+type addrDialer struct {
+	addr string
+}
+
+func (d addrDialer) Dial(network, _ string) (net.Conn, error) {
+	return net.Dial(network, d.addr)
+}
+
+func (d addrDialer) DialTimeout(network, _ string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout(network, d.addr, timeout)
+}
+
+// pgTLSVersion returns the TLS version of the agent's connection to Postgres, or an empty string if the connection is not encrypted
+func pgTLSVersion(db *sql.DB) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *flags.RdsDbQueryTimeout)
+	defer cancel()
+	var version sql.NullString
+	err := db.QueryRowContext(ctx, `SELECT version FROM pg_stat_ssl WHERE pid = pg_backend_pid()`).Scan(&version)
+	return version.String, err
+}
@@ -0,0 +1,29 @@
+package rds
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+func TestEmbeddedCaBundle(t *testing.T) {
+	rest := embeddedCaBundle
+	count := 0
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			t.Fatalf("failed to parse certificate #%d: %s", count+1, err)
+		}
+		count++
+	}
+	if count == 0 {
+		t.Fatal("the embedded RDS CA bundle contains no certificates")
+	}
+}
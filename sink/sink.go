@@ -0,0 +1,314 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/coroot/coroot-aws-agent/utils"
+	"github.com/coroot/logger"
+	"github.com/coroot/logparser"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	batchSize     = 1000
+	flushInterval = time.Second
+	maxRetries    = 5
+	minRetryDelay = 500 * time.Millisecond
+	maxRetryDelay = 10 * time.Second
+)
+
+var (
+	dSent    = utils.Desc("aws_agent_log_sink_entries_sent_total", "Number of log entries sent to the sink")
+	dDropped = utils.Desc("aws_agent_log_sink_entries_dropped_total", "Number of log entries dropped because the buffer was full or the sink was unavailable")
+)
+
+type Entry struct {
+	Timestamp time.Time
+	Level     logparser.Level
+	Body      string
+	// Attributes identify the source of the entry, they are sent as Loki stream labels
+	Attributes map[string]string
+	// Metadata are per-entry attributes like the DB user, they are sent as Loki structured metadata to keep the number of streams low
+	Metadata map[string]string
+}
+
+// Sink ships log entries to an OTLP/HTTP logs endpoint or to Loki in batches
+type Sink struct {
+	sent    uint64 // accessed atomically, must be 64-bit aligned
+	dropped uint64
+
+	url     string
+	format  string
+	headers map[string]string
+	client  *http.Client
+
+	ch   chan Entry
+	stop chan bool
+	done chan bool
+
+	logger logger.Logger
+}
+
+func New(url, format string, headers map[string]string, bufferSize int) (*Sink, error) {
+	switch format {
+	case "otlp", "loki":
+	default:
+		return nil, fmt.Errorf("unsupported log sink format: %s", format)
+	}
+	s := &Sink{
+		url:     url,
+		format:  format,
+		headers: headers,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		ch:      make(chan Entry, bufferSize),
+		stop:    make(chan bool),
+		done:    make(chan bool),
+		logger:  logger.NewKlog("log-sink"),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Send puts the entry into the buffer, the entry is dropped if the buffer is full
+func (s *Sink) Send(e Entry) {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+	select {
+	case s.ch <- e:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// Stop sends the buffered entries and waits until they are sent, failed batches are not retried
+func (s *Sink) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *Sink) run() {
+	defer close(s.done)
+	t := time.NewTicker(flushInterval)
+	defer t.Stop()
+	batch := make([]Entry, 0, batchSize)
+	for {
+		select {
+		case <-s.stop:
+			// the entries remaining in the buffer
+			for len(s.ch) > 0 {
+				batch = append(batch, <-s.ch)
+				if len(batch) >= batchSize {
+					s.flush(batch)
+					batch = batch[:0]
+				}
+			}
+			s.flush(batch)
+			return
+		case e := <-s.ch:
+			batch = append(batch, e)
+			if len(batch) >= batchSize {
+				s.flush(batch)
+				batch = batch[:0]
+			}
+		case <-t.C:
+			s.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (s *Sink) flush(batch []Entry) {
+	if len(batch) == 0 {
+		return
+	}
+	var body []byte
+	var err error
+	switch s.format {
+	case "otlp":
+		body, err = json.Marshal(otlpPayload(batch))
+	case "loki":
+		body, err = json.Marshal(lokiPayload(batch))
+	}
+	if err != nil {
+		s.logger.Warning("failed to encode log entries:", err)
+		atomic.AddUint64(&s.dropped, uint64(len(batch)))
+		return
+	}
+	delay := minRetryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(body)
+		if err == nil {
+			atomic.AddUint64(&s.sent, uint64(len(batch)))
+			return
+		}
+		if !retry || attempt >= maxRetries {
+			s.logger.Warningf("failed to send %d log entries: %s", len(batch), err)
+			atomic.AddUint64(&s.dropped, uint64(len(batch)))
+			return
+		}
+		select {
+		case <-s.stop:
+			atomic.AddUint64(&s.dropped, uint64(len(batch)))
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+func (s *Sink) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+func (s *Sink) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dSent
+	ch <- dDropped
+}
+
+func (s *Sink) Collect(ch chan<- prometheus.Metric) {
+	ch <- utils.Counter(dSent, float64(atomic.LoadUint64(&s.sent)))
+	ch <- utils.Counter(dDropped, float64(atomic.LoadUint64(&s.dropped)))
+}
+
+// https://opentelemetry.io/docs/specs/otel/logs/data-model/#field-severitynumber
+func severityNumber(level logparser.Level) int {
+	switch level {
+	case logparser.LevelDebug:
+		return 5
+	case logparser.LevelInfo:
+		return 9
+	case logparser.LevelWarning:
+		return 13
+	case logparser.LevelError:
+		return 17
+	case logparser.LevelCritical:
+		return 21
+	}
+	return 0
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano   string            `json:"timeUnixNano"`
+	SeverityNumber int               `json:"severityNumber"`
+	SeverityText   string            `json:"severityText"`
+	Body           map[string]string `json:"body"`
+	Attributes     []otlpAttribute   `json:"attributes"`
+}
+
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	res := make([]otlpAttribute, 0, len(attrs))
+	for k, v := range attrs {
+		a := otlpAttribute{Key: k}
+		a.Value.StringValue = v
+		res = append(res, a)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
+	return res
+}
+
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+func otlpPayload(batch []Entry) interface{} {
+	records := make([]otlpLogRecord, 0, len(batch))
+	for _, e := range batch {
+		attrs := map[string]string{"level": e.Level.String()}
+		for k, v := range e.Attributes {
+			attrs[k] = v
+		}
+		for k, v := range e.Metadata {
+			attrs[k] = v
+		}
+		records = append(records, otlpLogRecord{
+			TimeUnixNano:   strconv.FormatInt(e.Timestamp.UnixNano(), 10),
+			SeverityNumber: severityNumber(e.Level),
+			SeverityText:   strings.ToUpper(e.Level.String()),
+			Body:           map[string]string{"stringValue": e.Body},
+			Attributes:     otlpAttributes(attrs),
+		})
+	}
+	return map[string]interface{}{
+		"resourceLogs": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{"service.name": "coroot-aws-agent"}),
+				},
+				"scopeLogs": []interface{}{
+					map[string]interface{}{
+						"scope":      map[string]string{"name": "coroot-aws-agent"},
+						"logRecords": records,
+					},
+				},
+			},
+		},
+	}
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][]interface{}   `json:"values"`
+}
+
+// https://grafana.com/docs/loki/latest/reference/loki-http-api/#ingest-logs
+func lokiPayload(batch []Entry) interface{} {
+	streams := map[string]*lokiStream{}
+	var keys []string
+	for _, e := range batch {
+		labels := map[string]string{"level": e.Level.String()}
+		for k, v := range e.Attributes {
+			labels[k] = v
+		}
+		key := fmt.Sprint(labels) // fmt prints maps sorted by key
+		s := streams[key]
+		if s == nil {
+			s = &lokiStream{Stream: labels}
+			streams[key] = s
+			keys = append(keys, key)
+		}
+		v := []interface{}{strconv.FormatInt(e.Timestamp.UnixNano(), 10), e.Body}
+		if len(e.Metadata) > 0 {
+			v = append(v, e.Metadata)
+		}
+		s.Values = append(s.Values, v)
+	}
+	res := make([]*lokiStream, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, streams[k])
+	}
+	return map[string]interface{}{"streams": res}
+}
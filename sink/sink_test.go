@@ -0,0 +1,225 @@
+package sink
+
+import (
+	"encoding/json"
+	"github.com/coroot/logparser"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type request struct {
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+// newServer starts a server responding with the given statuses in turn, and with 200 once they are exhausted
+func newServer(t *testing.T, statuses ...int) (*httptest.Server, chan request) {
+	requests := make(chan request, 100)
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{header: r.Header, body: body, at: time.Now()}
+		if i := int(atomic.AddInt32(&n, 1)) - 1; i < len(statuses) {
+			w.WriteHeader(statuses[i])
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+func receive(t *testing.T, requests chan request) request {
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request received")
+	}
+	return request{}
+}
+
+func entry(body string) Entry {
+	return Entry{
+		Timestamp:  time.Unix(1700000000, 0),
+		Level:      logparser.LevelError,
+		Body:       body,
+		Attributes: map[string]string{"rds_instance_id": "us-east-1/db1"},
+		Metadata:   map[string]string{"db": "orders", "user": "app"},
+	}
+}
+
+func TestOtlp(t *testing.T) {
+	srv, requests := newServer(t)
+	s, err := New(srv.URL, "otlp", map[string]string{"Authorization": "Bearer token"}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Send(entry("first"))
+	s.Send(entry("second"))
+	s.Stop()
+
+	r := receive(t, requests)
+	if got := r.header.Get("Authorization"); got != "Bearer token" {
+		t.Errorf("Authorization header: %q", got)
+	}
+	var payload struct {
+		ResourceLogs []struct {
+			ScopeLogs []struct {
+				LogRecords []otlpLogRecord `json:"logRecords"`
+			} `json:"scopeLogs"`
+		} `json:"resourceLogs"`
+	}
+	if err := json.Unmarshal(r.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	records := payload.ResourceLogs[0].ScopeLogs[0].LogRecords
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	rec := records[0]
+	if rec.Body["stringValue"] != "first" || rec.TimeUnixNano != "1700000000000000000" || rec.SeverityNumber != 17 || rec.SeverityText != "ERROR" {
+		t.Errorf("unexpected record: %+v", rec)
+	}
+	attrs := map[string]string{}
+	for _, a := range rec.Attributes {
+		attrs[a.Key] = a.Value.StringValue
+	}
+	expected := map[string]string{"level": "error", "rds_instance_id": "us-east-1/db1", "db": "orders", "user": "app"}
+	for k, v := range expected {
+		if attrs[k] != v {
+			t.Errorf("attribute %s: expected %q, got %q", k, v, attrs[k])
+		}
+	}
+}
+
+func TestLoki(t *testing.T) {
+	srv, requests := newServer(t)
+	s, err := New(srv.URL, "loki", nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := entry("other user")
+	e.Metadata = map[string]string{"db": "orders", "user": "admin"}
+	s.Send(entry("first"))
+	s.Send(e)
+	s.Stop()
+
+	r := receive(t, requests)
+	var payload struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][]interface{}   `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(r.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	// the metadata must not split the entries into separate streams
+	if len(payload.Streams) != 1 {
+		t.Fatalf("expected 1 stream, got %d", len(payload.Streams))
+	}
+	stream := payload.Streams[0]
+	if len(stream.Stream) != 2 || stream.Stream["level"] != "error" || stream.Stream["rds_instance_id"] != "us-east-1/db1" {
+		t.Errorf("unexpected stream labels: %v", stream.Stream)
+	}
+	if len(stream.Values) != 2 {
+		t.Fatalf("expected 2 values, got %d", len(stream.Values))
+	}
+	v := stream.Values[1]
+	if len(v) != 3 || v[0] != "1700000000000000000" || v[1] != "other user" {
+		t.Fatalf("unexpected value: %v", v)
+	}
+	if md, _ := v[2].(map[string]interface{}); md["user"] != "admin" || md["db"] != "orders" {
+		t.Errorf("unexpected structured metadata: %v", v[2])
+	}
+}
+
+func TestBatching(t *testing.T) {
+	srv, requests := newServer(t)
+	s, err := New(srv.URL, "loki", nil, 2*batchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < batchSize+1; i++ {
+		s.Send(Entry{Body: "line"})
+	}
+	count := func(r request) int {
+		var payload struct {
+			Streams []lokiStream `json:"streams"`
+		}
+		if err := json.Unmarshal(r.body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, s := range payload.Streams {
+			n += len(s.Values)
+		}
+		return n
+	}
+	// a full batch is sent without waiting for the flush interval
+	if n := count(receive(t, requests)); n != batchSize {
+		t.Errorf("expected a batch of %d entries, got %d", batchSize, n)
+	}
+	// the rest is sent on the next tick
+	if n := count(receive(t, requests)); n != 1 {
+		t.Errorf("expected a batch of 1 entry, got %d", n)
+	}
+	s.Stop()
+	if sent := atomic.LoadUint64(&s.sent); sent != batchSize+1 {
+		t.Errorf("expected %d entries sent, got %d", batchSize+1, sent)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	srv, requests := newServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	s, err := New(srv.URL, "otlp", nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Send(entry("line"))
+	r1, r2, r3 := receive(t, requests), receive(t, requests), receive(t, requests)
+	s.Stop()
+
+	// the delay doubles after every failed attempt
+	if d := r2.at.Sub(r1.at); d < minRetryDelay {
+		t.Errorf("the first retry was made after %s", d)
+	}
+	if d := r3.at.Sub(r2.at); d < 2*minRetryDelay {
+		t.Errorf("the second retry was made after %s", d)
+	}
+	if sent, dropped := atomic.LoadUint64(&s.sent), atomic.LoadUint64(&s.dropped); sent != 1 || dropped != 0 {
+		t.Errorf("expected 1 entry sent and 0 dropped, got %d and %d", sent, dropped)
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	srv, requests := newServer(t, http.StatusBadRequest)
+	s, err := New(srv.URL, "otlp", nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Send(entry("line"))
+	s.Stop()
+
+	receive(t, requests)
+	select {
+	case <-requests:
+		t.Error("a rejected batch must not be retried")
+	default:
+	}
+	if sent, dropped := atomic.LoadUint64(&s.sent), atomic.LoadUint64(&s.dropped); sent != 0 || dropped != 1 {
+		t.Errorf("expected 0 entries sent and 1 dropped, got %d and %d", sent, dropped)
+	}
+}
+
+func TestUnsupportedFormat(t *testing.T) {
+	if _, err := New("http://localhost", "syslog", nil, 10); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	minRetryDelay  = 30 * time.Second
+	maxRetryDelay  = 10 * time.Minute
+	healthLabelKey = "collector"
+)
+
+// ErrDown is reported when the target is unreachable according to the exporter, which doesn't return the error itself
+var ErrDown = errors.New("the target is down")
+
+var (
+	dCollectorUp          = Desc("aws_agent_collector_up", "Whether the last run of the collector succeeded", healthLabelKey)
+	dCollectorLastSuccess = Desc("aws_agent_collector_last_success_timestamp_seconds", "Timestamp of the last successful run of the collector", healthLabelKey)
+	dCollectorLastError   = Desc("aws_agent_collector_last_error_timestamp_seconds", "Timestamp of the last failed run of the collector", healthLabelKey, "reason")
+	dCollectorDuration    = Desc("aws_agent_collector_duration_seconds", "Duration of the last run of the collector", healthLabelKey)
+)
+
+// Health tracks the state of a sub-collector (db, logs, os, cache) and the backoff of its initialization retries
+type Health struct {
+	name string
+
+	up          bool
+	lastSuccess time.Time
+	lastError   time.Time
+	reason      string
+	duration    time.Duration
+
+	failures  int
+	nextRetry time.Time
+
+	lock sync.Mutex
+}
+
+func NewHealth(name string) *Health {
+	return &Health{name: name}
+}
+
+func (h *Health) Success(duration time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.up = true
+	h.lastSuccess = time.Now()
+	h.duration = duration
+	h.failures = 0
+	h.nextRetry = time.Time{}
+}
+
+func (h *Health) Failure(err error, duration time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.up = false
+	h.lastError = time.Now()
+	h.reason = Reason(err)
+	h.duration = duration
+	// a scrape may fail many times before the retry is due, that mustn't postpone it
+	if !h.nextRetry.IsZero() && h.lastError.Before(h.nextRetry) {
+		return
+	}
+	delay := maxRetryDelay
+	if h.failures < 10 && minRetryDelay<<h.failures < maxRetryDelay {
+		delay = minRetryDelay << h.failures
+	}
+	h.failures++
+	h.nextRetry = h.lastError.Add(delay)
+}
+
+// Up reports whether the last run of the collector succeeded
+func (h *Health) Up() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.up
+}
+
+// RetryDue reports whether the failed collector can be initialized again according to the backoff
+func (h *Health) RetryDue() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return !h.up && !h.nextRetry.IsZero() && time.Now().After(h.nextRetry)
+}
+
+func (h *Health) Collect(ch chan<- prometheus.Metric) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.lastSuccess.IsZero() && h.lastError.IsZero() {
+		return
+	}
+	up := 0.
+	if h.up {
+		up = 1
+	}
+	ch <- Gauge(dCollectorUp, up, h.name)
+	ch <- Gauge(dCollectorDuration, h.duration.Seconds(), h.name)
+	if !h.lastSuccess.IsZero() {
+		ch <- Gauge(dCollectorLastSuccess, float64(h.lastSuccess.Unix()), h.name)
+	}
+	if !h.lastError.IsZero() {
+		ch <- Gauge(dCollectorLastError, float64(h.lastError.Unix()), h.name, h.reason)
+	}
+}
+
+func DescribeHealth(ch chan<- *prometheus.Desc) {
+	ch <- dCollectorUp
+	ch <- dCollectorLastSuccess
+	ch <- dCollectorLastError
+	ch <- dCollectorDuration
+}
+
+// Reason maps an error to one of a fixed set of values of the reason label, so the raw errors containing addresses,
+// IDs and other details don't produce a new series each
+func Reason(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var recordErr tls.RecordHeaderError
+	msg := strings.ToLower(err.Error())
+	switch {
+	case errors.Is(err, ErrDown):
+		return "down"
+	case errors.As(err, &dnsErr) || strings.Contains(msg, "no such host"):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED) || strings.Contains(msg, "connection refused"):
+		return "connection_refused"
+	case errors.As(err, &certErr) || errors.As(err, &hostnameErr) || errors.As(err, &recordErr) ||
+		strings.Contains(msg, "x509:") || strings.Contains(msg, "tls:") || strings.Contains(msg, "ssl"):
+		return "tls"
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() || strings.Contains(msg, "timeout"):
+		return "timeout"
+	case strings.Contains(msg, "authentication failed") || strings.Contains(msg, "access denied") ||
+		strings.Contains(msg, "wrongpass") || strings.Contains(msg, "noauth") || strings.Contains(msg, "invalid password") ||
+		strings.Contains(msg, "not authorized") || strings.Contains(msg, "accessdenied"):
+		return "auth"
+	}
+	return "other"
+}
@@ -3,6 +3,7 @@ package utils
 import (
 	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"path/filepath"
 	"strings"
 )
@@ -44,3 +45,37 @@ func Gauge(desc *prometheus.Desc, value float64, labels ...string) prometheus.Me
 func Counter(desc *prometheus.Desc, value float64, labels ...string) prometheus.Metric {
 	return prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labels...)
 }
+
+func Histogram(desc *prometheus.Desc, count uint64, sum float64, buckets map[float64]uint64, labels ...string) prometheus.Metric {
+	return prometheus.MustNewConstHistogram(desc, count, sum, buckets, labels...)
+}
+
+func Match(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if matched, _ := filepath.Match(p, s); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// CollectUp passes the metrics of an exporter through and returns the value of its up metric, e.g. redis_up.
+// The exporters don't return errors, so that's the only way to know whether the target is reachable.
+func CollectUp(c prometheus.Collector, ch chan<- prometheus.Metric, upMetric string) (up bool, found bool) {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(metrics)
+		close(metrics)
+	}()
+	name := `fqName: "` + upMetric + `"`
+	for m := range metrics {
+		if !found && strings.Contains(m.Desc().String(), name) {
+			var pb dto.Metric
+			if err := m.Write(&pb); err == nil && pb.Gauge != nil {
+				found, up = true, pb.Gauge.GetValue() == 1
+			}
+		}
+		ch <- m
+	}
+	return up, found
+}